@@ -0,0 +1,59 @@
+package admmonkit
+
+import (
+	"sync"
+	"time"
+)
+
+// Changes remembers the values sent by Send so that later calls can skip the
+// series whose values have not changed. Every refresh interval, Send sends
+// every series so that receivers can still detect series that have gone
+// stale. It is safe for concurrent use.
+type Changes struct {
+	mu      sync.Mutex
+	refresh time.Duration
+	full    time.Time
+	sent    map[string]float64
+}
+
+// NewChanges returns a Changes that causes Send to send every series at least
+// once every refresh interval. A zero interval sends every series every time.
+func NewChanges(refresh time.Duration) *Changes {
+	return &Changes{
+		refresh: refresh,
+		sent:    make(map[string]float64),
+	}
+}
+
+// begin returns true if a Send starting at now should send every series.
+func (c *Changes) begin(now time.Time) (full bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.full.IsZero() || now.Sub(c.full) >= c.refresh
+}
+
+// unchanged returns true if the series was last sent with the value.
+func (c *Changes) unchanged(series string, value float64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last, ok := c.sent[series]
+	return ok && last == value
+}
+
+// commit records the values sent by a successful Send that started at now. If
+// it was a full send, any series that were not sent are forgotten.
+func (c *Changes) commit(now time.Time, full bool, values map[string]float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if full {
+		c.full = now
+		c.sent = values
+		return
+	}
+	for series, value := range values {
+		c.sent[series] = value
+	}
+}
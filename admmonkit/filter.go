@@ -0,0 +1,104 @@
+package admmonkit
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/spacemonkeygo/monkit/v3"
+)
+
+// Matcher reports if a string matches some pattern.
+type Matcher interface {
+	Match(s string) bool
+}
+
+// prefixMatcher matches strings that start with a prefix.
+type prefixMatcher string
+
+func (p prefixMatcher) Match(s string) bool { return strings.HasPrefix(s, string(p)) }
+
+// regexpMatcher matches strings with a regular expression.
+type regexpMatcher struct{ re *regexp.Regexp }
+
+func (r regexpMatcher) Match(s string) bool { return r.re.MatchString(s) }
+
+// Prefix returns a Matcher for strings that start with the prefix.
+func Prefix(prefix string) Matcher {
+	return prefixMatcher(prefix)
+}
+
+// Glob returns a Matcher for strings that entirely match the pattern, where *
+// matches any run of characters and ? matches any single character. Unlike
+// path.Match, neither treats / specially.
+func Glob(pattern string) (Matcher, error) {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, `.*`, -1)
+	expr = strings.Replace(expr, `\?`, `.`, -1)
+	return Regexp("^(?s:" + expr + ")$")
+}
+
+// Regexp returns a Matcher for strings that contain a match of the regular
+// expression.
+func Regexp(expr string) (Matcher, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return regexpMatcher{re: re}, nil
+}
+
+// Filter selects series by their measurement, field and tags. A series is
+// selected if every Matcher that is set matches.
+type Filter struct {
+	// Measurement matches the measurement of the series key.
+	Measurement Matcher
+
+	// Field matches the field of the series.
+	Field Matcher
+
+	// Tags match the values of the tags in the series key by tag name. A
+	// series without the tag is not selected.
+	Tags map[string]Matcher
+}
+
+// Match returns true if the series is selected by the filter.
+func (f Filter) Match(key monkit.SeriesKey, field string) bool {
+	if f.Measurement != nil && !f.Measurement.Match(key.Measurement) {
+		return false
+	}
+	if f.Field != nil && !f.Field.Match(field) {
+		return false
+	}
+	if len(f.Tags) == 0 {
+		return true
+	}
+
+	// All copies the tags, so only do it once.
+	tags := key.Tags.All()
+	for tag, matcher := range f.Tags {
+		value, ok := tags[tag]
+		if !ok || !matcher.Match(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterSeries returns true if the series should not be sent according to the
+// Allow and Deny filters in the options.
+func filterSeries(opts *Options, key monkit.SeriesKey, field string) bool {
+	if len(opts.Allow) > 0 && !anyMatch(opts.Allow, key, field) {
+		return true
+	}
+	return anyMatch(opts.Deny, key, field)
+}
+
+// anyMatch returns true if any of the filters select the series.
+func anyMatch(filters []Filter, key monkit.SeriesKey, field string) bool {
+	for _, filter := range filters {
+		if filter.Match(key, field) {
+			return true
+		}
+	}
+	return false
+}
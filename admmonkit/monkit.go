@@ -3,14 +3,22 @@ package admmonkit
 
 import (
 	"context"
+	"io"
 	"log"
-	"net"
+	"reflect"
+	"sort"
 	"syscall"
+	"time"
 
 	"github.com/spacemonkeygo/monkit/v3"
 	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/internal/packet"
+	"github.com/zeebo/errs"
 )
 
+// Error wraps the errors coming out of admmonkit.
+var Error = errs.Class("admmonkit")
+
 // Options allows you to control where and how Send sends the data.
 type Options struct {
 	// Application to send with
@@ -19,7 +27,8 @@ type Options struct {
 	// Instance Id to send with
 	InstanceId []byte
 
-	// Address to send packets to
+	// Address to send packets to. It is a UDP host and port, or the path to
+	// a unix datagram socket prefixed with unixgram://.
 	Address string
 
 	// PacketSize controls maximum packet size. If zero, 1024 is used.
@@ -28,45 +37,247 @@ type Options struct {
 	// Registry to pull stats from. If nil, monkit.Default is used.
 	Registry *monkit.Registry
 
-	// ProtoOps allows you to set protocol options.
+	// ProtoOps allows you to set protocol options. If the Labels option is
+	// set, series tags are sent as labels, which collectors must be new enough
+	// to read. Otherwise they are sent as part of the key. If the Delta
+	// option is set, every call to Send is a frame.
+	ProtoOpts admproto.Options
+
+	// Headers allow you to set arbitrary key/value pairs to be included in each packet send
+	Headers map[string]string
+
+	// Stream, if set, is sent the packets instead of Address. It is not
+	// closed by Send.
+	Stream *StreamSender
+
+	// Changes, if set, causes Send to skip any series whose value has not
+	// changed since the last successful Send with the same Changes.
+	Changes *Changes
+
+	// Allow, if not empty, causes Send to only send the series selected by
+	// at least one of the filters.
+	Allow []Filter
+
+	// Deny causes Send to skip any series selected by any of the filters,
+	// even if they are selected by Allow.
+	Deny []Filter
+
+	// Rename, if set, is called with every series that is not filtered and
+	// returns the key and field to send it as.
+	Rename func(key monkit.SeriesKey, field string) (monkit.SeriesKey, string)
+
+	// Destinations are sent the same series as Address, each with their own
+	// options. Destinations that have the same options as each other share
+	// the encoded packets. Each must have its own DeltaState if they use the
+	// Delta option with different options, and Send returns an error if one
+	// is shared.
+	Destinations []Destination
+
+	// Hooks provide callbacks for events in Send.
+	Hooks struct {
+		// when series were filtered with how many.
+		FilteredSeries func(ctx context.Context, n int)
+	}
+}
+
+// Destination is an additional place for Send to send packets to, with its
+// own options for how the packets are encoded.
+type Destination struct {
+	// Address to send packets to. It is a UDP host and port, or the path to
+	// a unix datagram socket prefixed with unixgram://.
+	Address string
+
+	// PacketSize controls maximum packet size. If zero, 1024 is used.
+	PacketSize int
+
+	// ProtoOps allows you to set protocol options. If the Labels option is
+	// set, series tags are sent as labels, which collectors must be new enough
+	// to read. Otherwise they are sent as part of the key. If the Delta
+	// option is set, every call to Send is a frame.
 	ProtoOpts admproto.Options
 
 	// Headers allow you to set arbitrary key/value pairs to be included in each packet send
 	Headers map[string]string
+
+	// Stream, if set, is sent the packets instead of Address. It is not
+	// closed by Send.
+	Stream *StreamSender
+}
+
+// sample is a single series value to be sent. The series and labels are set
+// if a destination uses labels, and the flat key if one does not.
+type sample struct {
+	series string
+	labels []admproto.Label
+	flat   string
+	value  float64
+}
+
+// destGroup is a set of destinations that have the same encoding options.
+type destGroup struct {
+	dest  Destination
+	conns []io.Writer
 }
 
 // Send will push all of the metrics in the registry to the address with the
-// application and instance id in the options.
+// application and instance id in the options, and to any other destinations.
+// The series are gathered from the registry once, and destinations with the
+// same options share the encoded packets. If some destinations fail, the rest
+// are still sent to.
 func Send(ctx context.Context, opts Options) (err error) {
-	addr, err := net.ResolveUDPAddr("udp", opts.Address)
-	if err != nil {
-		return err
+	if opts.Registry == nil {
+		opts.Registry = monkit.Default
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
-		return err
+	// the options describe the first destination unless there is only a
+	// list of other destinations.
+	var dests []Destination
+	if opts.Address != "" || opts.Stream != nil || len(opts.Destinations) == 0 {
+		dests = append(dests, Destination{
+			Address:    opts.Address,
+			PacketSize: opts.PacketSize,
+			ProtoOpts:  opts.ProtoOpts,
+			Headers:    opts.Headers,
+			Stream:     opts.Stream,
+		})
 	}
-	defer conn.Close()
+	dests = append(dests, opts.Destinations...)
 
-	if opts.Registry == nil {
-		opts.Registry = monkit.Default
+	// connect to every destination and group them by their options.
+	var group errs.Group
+	var groups []*destGroup
+	for _, dest := range dests {
+		if dest.PacketSize == 0 {
+			dest.PacketSize = 1024
+		}
+
+		if dest.Stream != nil {
+			groups = addToGroup(groups, dest, dest.Stream)
+			continue
+		}
+
+		conn, err := packet.Dial(dest.Address)
+		if err != nil {
+			group.Add(err)
+			continue
+		}
+		defer conn.Close()
+
+		groups = addToGroup(groups, dest, conn)
+	}
+	if len(groups) == 0 {
+		return group.Err()
+	}
+
+	// a delta state is advanced once per group, so it cannot be shared by
+	// destinations that were not grouped together.
+	deltas := make(map[*admproto.DeltaState]bool)
+	for _, g := range groups {
+		if delta := g.dest.ProtoOpts.Delta; delta != nil {
+			if deltas[delta] {
+				return Error.New("delta state shared by destinations with different options")
+			}
+			deltas[delta] = true
+		}
 	}
-	if opts.PacketSize == 0 {
-		opts.PacketSize = 1024
+
+	// only build the forms of the series that some destination sends.
+	var labeled, flat bool
+	for _, g := range groups {
+		if g.dest.ProtoOpts.Delta != nil {
+			g.dest.ProtoOpts.Delta.Advance()
+		}
+		if g.dest.ProtoOpts.Labels {
+			labeled = true
+		} else {
+			flat = true
+		}
 	}
 
 	var (
-		buf []byte
-		w   = admproto.NewWriterWith(opts.ProtoOpts)
+		samples  []sample
+		now      = time.Now()
+		full     bool
+		changed  map[string]float64
+		filtered int
 	)
 
+	if opts.Changes != nil {
+		full = opts.Changes.begin(now)
+		changed = make(map[string]float64)
+	}
+
 	opts.Registry.Stats(func(key monkit.SeriesKey, field string, value float64) {
-		// if we have any errors, stop.
-		if err != nil {
+		// skip the series if it is filtered, and rename it if it isn't.
+		if filterSeries(&opts, key, field) {
+			filtered++
 			return
 		}
+		if opts.Rename != nil {
+			key, field = opts.Rename(key, field)
+		}
+
+		// skip the series if it has not changed since it was last sent.
+		if opts.Changes != nil {
+			name := key.WithField(field)
+			if !full && opts.Changes.unchanged(name, value) {
+				return
+			}
+			changed[name] = value
+		}
+
+		// with labels, the series is sent as the measurement and field, with
+		// the tags sent as labels rather than being flattened into the key.
+		s := sample{value: value}
+		if labeled {
+			s.series = monkit.NewSeriesKey(key.Measurement).WithField(field)
+			s.labels = appendTags(nil, key.Tags)
+		}
+		if flat {
+			s.flat = key.WithField(field)
+		}
+		samples = append(samples, s)
+	})
+
+	for _, g := range groups {
+		group.Add(sendGroup(ctx, opts, g, samples))
+	}
+
+	err = group.Err()
+	if err == nil && opts.Changes != nil {
+		opts.Changes.commit(now, full, changed)
+	}
+	if opts.Hooks.FilteredSeries != nil {
+		opts.Hooks.FilteredSeries(ctx, filtered)
+	}
+
+	return err
+}
 
+// addToGroup adds the connection to the group with the same options as the
+// destination, creating one if necessary.
+func addToGroup(groups []*destGroup, dest Destination, conn io.Writer) []*destGroup {
+	for _, g := range groups {
+		if g.dest.PacketSize == dest.PacketSize &&
+			g.dest.ProtoOpts == dest.ProtoOpts &&
+			reflect.DeepEqual(g.dest.Headers, dest.Headers) {
+
+			g.conns = append(g.conns, conn)
+			return groups
+		}
+	}
+	return append(groups, &destGroup{dest: dest, conns: []io.Writer{conn}})
+}
+
+// sendGroup encodes the samples into packets with the options of the group and
+// sends the packets to every connection in the group.
+func sendGroup(ctx context.Context, opts Options, g *destGroup, samples []sample) (err error) {
+	var (
+		buf []byte
+		w   = admproto.NewWriterWith(g.dest.ProtoOpts)
+	)
+
+	for _, sample := range samples {
 		for {
 			// keep track of the buffer before we send
 			before := buf
@@ -74,32 +285,35 @@ func Send(ctx context.Context, opts Options) (err error) {
 			// always ensure the buffer has the prefix in it.
 			if len(buf) == 0 {
 				// if we can't add the application and instance id, it's fatal.
-				buf, err = w.Begin(buf, opts.Application, opts.InstanceId, len(opts.Headers))
+				buf, err = w.Begin(buf, opts.Application, opts.InstanceId, len(g.dest.Headers))
 				if err != nil {
-					return
+					return err
 				}
-				for key, value := range opts.Headers {
+				for key, value := range g.dest.Headers {
 					buf, err = w.AppendHeader(buf, []byte(key), []byte(value))
 					if err != nil {
-						return
+						return err
 					}
 				}
 			}
 
 			// add the value to the buffer
-			series := key.WithField(field)
-			buf, err = w.Append(buf, series, value)
+			if g.dest.ProtoOpts.Labels {
+				buf, err = w.AppendLabeled(buf, sample.series, sample.labels, sample.value)
+			} else {
+				buf, err = w.Append(buf, sample.flat, sample.value)
+			}
 			if err != nil {
 				// not fatal, just back up to before, but let someone know
 				// it has been skipped.
-				log.Println("skipped metric", series, "because", err)
-				buf, err = before, nil
-				return
+				log.Println("skipped metric", sample.series, sample.labels, sample.flat, "because", err)
+				buf = before
+				break
 			}
 
 			// if we're still in the packet size, then get the next metric.
-			if len(buf)+4 <= opts.PacketSize {
-				return
+			if len(buf)+4 <= g.dest.PacketSize {
+				break
 			}
 
 			// if we're over the packet size, send the previous value and start
@@ -107,9 +321,9 @@ func Send(ctx context.Context, opts Options) (err error) {
 			// if buf was empty at the start, we should just send it.
 			// otherwise we should send the previous value.
 			if len(before) == 0 {
-				sendPacket(ctx, conn, buf)
+				sendPacket(ctx, g.conns, buf)
 			} else {
-				sendPacket(ctx, conn, before)
+				sendPacket(ctx, g.conns, before)
 			}
 
 			// after sending the packet, we should reset the buffer and try to
@@ -118,27 +332,40 @@ func Send(ctx context.Context, opts Options) (err error) {
 			buf = buf[:0]
 
 			// if we had no buffer at the start, then we sent this metric, so
-			// return to get the next metric.
+			// go on to the next metric.
 			if len(before) == 0 {
-				return
+				break
 			}
 		}
-	})
+	}
 
 	// send off any remainder buf. we're guaranteed by the loop above that if
 	// there is any data in buf it forms a valid packet with metrics in it.
-	if err == nil && len(buf) > 0 {
-		sendPacket(ctx, conn, buf)
+	if len(buf) > 0 {
+		sendPacket(ctx, g.conns, buf)
 	}
 
-	return err
+	return nil
+}
+
+// appendTags appends the tags in the set to labels sorted by key, so that
+// series from the same scope share as many labels as possible.
+func appendTags(labels []admproto.Label, tags *monkit.TagSet) []admproto.Label {
+	for key, value := range tags.All() {
+		labels = append(labels, admproto.Label{Key: key, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Key < labels[j].Key })
+	return labels
 }
 
 // sendPacket is a helper that adds a checksum to the provided buffer and sends
-// it to the conn. It logs if there was an error.
-func sendPacket(ctx context.Context, conn *net.UDPConn, buf []byte) {
-	_, err := conn.Write(admproto.AddChecksum(buf))
-	if err != nil && err != syscall.ENOBUFS {
-		log.Println("failed to send packet:", err)
+// it to the conns. It logs if there was an error.
+func sendPacket(ctx context.Context, conns []io.Writer, buf []byte) {
+	packet := admproto.AddChecksum(buf)
+	for _, conn := range conns {
+		_, err := conn.Write(packet)
+		if err != nil && err != syscall.ENOBUFS {
+			log.Println("failed to send packet:", err)
+		}
 	}
 }
@@ -3,13 +3,69 @@ package admmonkit
 import (
 	"context"
 	"encoding/hex"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/spacemonkeygo/monkit/v3"
+	"github.com/zeebo/admission/v3/admproto"
 	"github.com/zeebo/assert"
 )
 
+// point is a decoded point from a packet.
+type point struct {
+	key    string
+	labels map[string]string
+	value  float64
+}
+
+// readPoints reads a packet from the conn and decodes the points in it.
+func readPoints(t *testing.T, conn net.Conn) (application string, points []point) {
+	t.Helper()
+
+	var buf [4096]byte
+	n, err := conn.Read(buf[:])
+	assert.NoError(t, err)
+
+	return decodePoints(t, buf[:n])
+}
+
+// decodePoints decodes the points in the datagram.
+func decodePoints(t *testing.T, datagram []byte) (application string, points []point) {
+	t.Helper()
+
+	data, err := admproto.CheckChecksum(datagram)
+	assert.NoError(t, err)
+
+	var r admproto.Reader
+	data, app, _, num_headers, err := r.Begin(data)
+	assert.NoError(t, err)
+	for i := 0; i < num_headers; i++ {
+		data, _, _, err = r.NextHeader(data)
+		assert.NoError(t, err)
+	}
+
+	for len(data) > 0 {
+		var key []byte
+		var value float64
+		data, key, value, err = r.Next(data)
+		assert.NoError(t, err)
+
+		labels := make(map[string]string)
+		for _, label := range r.Labels() {
+			labels[label.Key] = label.Value
+		}
+		points = append(points, point{key: string(key), labels: labels, value: value})
+	}
+
+	return string(app), points
+}
+
 func TestSend_NoSpinning(t *testing.T) {
 	addr, err := net.ResolveUDPAddr("udp", ":0")
 	assert.NoError(t, err)
@@ -38,3 +94,291 @@ func TestSend_NoSpinning(t *testing.T) {
 
 	assert.NoError(t, <-errc)
 }
+
+func TestSend_Labels(t *testing.T) {
+	addr, err := net.ResolveUDPAddr("udp", ":0")
+	assert.NoError(t, err)
+	conn, err := net.ListenUDP("udp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	registry := monkit.NewRegistry()
+	registry.ScopeNamed("test").IntVal("some_val").Observe(5)
+
+	send := func(labels bool) []point {
+		assert.NoError(t, Send(context.Background(), Options{
+			Application: "app",
+			InstanceId:  []byte("inst"),
+			Address:     conn.LocalAddr().String(),
+			Registry:    registry,
+			ProtoOpts:   admproto.Options{Labels: labels},
+		}))
+		application, points := readPoints(t, conn)
+		assert.Equal(t, application, "app")
+		assert.That(t, len(points) > 0)
+		return points
+	}
+
+	// by default, the tags are part of the key.
+	for _, point := range send(false) {
+		assert.That(t, strings.HasPrefix(point.key, "some_val,scope=test "))
+		assert.Equal(t, len(point.labels), 0)
+	}
+
+	// with the option, they are sent as labels.
+	for _, point := range send(true) {
+		assert.That(t, strings.HasPrefix(point.key, "some_val "))
+		assert.Equal(t, point.labels["scope"], "test")
+	}
+}
+
+func TestSend_Changes(t *testing.T) {
+	addr, err := net.ResolveUDPAddr("udp", ":0")
+	assert.NoError(t, err)
+	conn, err := net.ListenUDP("udp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	a, b := 1.0, 2.0
+	registry := monkit.NewRegistry()
+	registry.ScopeNamed("test").Gauge("a", func() float64 { return a })
+	registry.ScopeNamed("test").Gauge("b", func() float64 { return b })
+
+	send := func(changes *Changes) []point {
+		assert.NoError(t, Send(context.Background(), Options{
+			Application: "app",
+			InstanceId:  []byte("inst"),
+			Address:     conn.LocalAddr().String(),
+			Registry:    registry,
+			Changes:     changes,
+		}))
+		_, points := readPoints(t, conn)
+		return points
+	}
+
+	// the first send is always full and the second only has the change.
+	changes := NewChanges(time.Hour)
+	assert.Equal(t, len(send(changes)), 2)
+	b = 3
+	points := send(changes)
+	assert.Equal(t, len(points), 1)
+	assert.Equal(t, points[0].key, "b,scope=test value")
+	assert.Equal(t, points[0].value, 3.0)
+
+	// a zero refresh interval always sends everything.
+	changes = NewChanges(0)
+	assert.Equal(t, len(send(changes)), 2)
+	assert.Equal(t, len(send(changes)), 2)
+}
+
+func TestSend_Filters(t *testing.T) {
+	addr, err := net.ResolveUDPAddr("udp", ":0")
+	assert.NoError(t, err)
+	conn, err := net.ListenUDP("udp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	registry := monkit.NewRegistry()
+	registry.ScopeNamed("test").Gauge("keep", func() float64 { return 1 })
+	registry.ScopeNamed("test").Gauge("keep_noisy", func() float64 { return 2 })
+	registry.ScopeNamed("other").Gauge("keep", func() float64 { return 3 })
+	registry.ScopeNamed("test").Gauge("drop", func() float64 { return 4 })
+
+	glob, err := Glob("*noisy")
+	assert.NoError(t, err)
+	re, err := Regexp("^te")
+	assert.NoError(t, err)
+
+	var filtered int
+	opts := Options{
+		Application: "app",
+		InstanceId:  []byte("inst"),
+		Address:     conn.LocalAddr().String(),
+		Registry:    registry,
+		ProtoOpts:   admproto.Options{Labels: true},
+		Allow: []Filter{
+			{Measurement: Prefix("keep"), Tags: map[string]Matcher{"scope": re}},
+		},
+		Deny: []Filter{
+			{Measurement: glob},
+		},
+		Rename: func(key monkit.SeriesKey, field string) (monkit.SeriesKey, string) {
+			return key, "renamed"
+		},
+	}
+	opts.Hooks.FilteredSeries = func(ctx context.Context, n int) { filtered = n }
+
+	assert.NoError(t, Send(context.Background(), opts))
+	_, points := readPoints(t, conn)
+	assert.Equal(t, len(points), 1)
+	assert.Equal(t, points[0].key, "keep renamed")
+	assert.Equal(t, points[0].labels["scope"], "test")
+	assert.Equal(t, filtered, 3)
+}
+
+func TestSend_Destinations(t *testing.T) {
+	listen := func() *net.UDPConn {
+		addr, err := net.ResolveUDPAddr("udp", ":0")
+		assert.NoError(t, err)
+		conn, err := net.ListenUDP("udp", addr)
+		assert.NoError(t, err)
+		return conn
+	}
+
+	primary, shadow, other := listen(), listen(), listen()
+	defer primary.Close()
+	defer shadow.Close()
+	defer other.Close()
+
+	registry := monkit.NewRegistry()
+	registry.ScopeNamed("test").Gauge("a", func() float64 { return 1.5 })
+
+	assert.NoError(t, Send(context.Background(), Options{
+		Application: "app",
+		InstanceId:  []byte("inst"),
+		Address:     primary.LocalAddr().String(),
+		Registry:    registry,
+		Destinations: []Destination{
+			{
+				Address:   shadow.LocalAddr().String(),
+				ProtoOpts: admproto.Options{Labels: true},
+			},
+			{
+				Address:   other.LocalAddr().String(),
+				ProtoOpts: admproto.Options{FloatEncoding: admproto.Float64Encoding},
+				Headers:   map[string]string{"dc": "east"},
+			},
+		},
+	}))
+
+	for _, conn := range []*net.UDPConn{primary, shadow, other} {
+		application, points := readPoints(t, conn)
+		assert.Equal(t, application, "app")
+		assert.Equal(t, len(points), 1)
+		assert.Equal(t, points[0].value, 1.5)
+
+		// only the shadow destination sends the tags as labels.
+		if conn == shadow {
+			assert.Equal(t, points[0].key, "a value")
+			assert.Equal(t, points[0].labels["scope"], "test")
+		} else {
+			assert.Equal(t, points[0].key, "a,scope=test value")
+		}
+	}
+}
+
+func TestSend_SharedDelta(t *testing.T) {
+	addr, err := net.ResolveUDPAddr("udp", ":0")
+	assert.NoError(t, err)
+	conn, err := net.ListenUDP("udp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	registry := monkit.NewRegistry()
+	registry.ScopeNamed("test").Gauge("a", func() float64 { return 1 })
+
+	send := func(delta *admproto.DeltaState, encoding admproto.FloatEncoding) error {
+		return Send(context.Background(), Options{
+			Application: "app",
+			InstanceId:  []byte("inst"),
+			Address:     conn.LocalAddr().String(),
+			Registry:    registry,
+			ProtoOpts:   admproto.Options{Delta: delta},
+			Destinations: []Destination{{
+				Address:   conn.LocalAddr().String(),
+				ProtoOpts: admproto.Options{Delta: delta, FloatEncoding: encoding},
+			}},
+		})
+	}
+
+	// destinations with the same options share the packets, and so the state.
+	delta := admproto.NewDeltaState(10)
+	assert.NoError(t, send(delta, 0))
+	readPoints(t, conn)
+	readPoints(t, conn)
+
+	// otherwise the state would be advanced twice.
+	assert.Error(t, send(delta, admproto.Float64Encoding))
+}
+
+func TestSend_Unixgram(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix datagram sockets are not supported")
+	}
+
+	dir, err := ioutil.TempDir("", "admmonkit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	registry := monkit.NewRegistry()
+	registry.ScopeNamed("test").Gauge("a", func() float64 { return 1 })
+
+	assert.NoError(t, Send(context.Background(), Options{
+		Application: "app",
+		InstanceId:  []byte("inst"),
+		Address:     "unixgram://" + path,
+		Registry:    registry,
+	}))
+
+	application, points := readPoints(t, conn)
+	assert.Equal(t, application, "app")
+	assert.Equal(t, len(points), 1)
+	assert.Equal(t, points[0].key, "a,scope=test value")
+}
+
+func TestSend_Stream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	stream := NewStreamSender(listener.Addr().String(), 0)
+	defer stream.Close()
+
+	registry := monkit.NewRegistry()
+	registry.ScopeNamed("test").Gauge("a", func() float64 { return 1 })
+
+	send := func() {
+		assert.NoError(t, Send(context.Background(), Options{
+			Application: "app",
+			InstanceId:  []byte("inst"),
+			Stream:      stream,
+			Registry:    registry,
+		}))
+	}
+
+	receive := func(conn net.Conn) {
+		datagram, err := admproto.ReadFrame(conn, make([]byte, 4096))
+		assert.NoError(t, err)
+		application, points := decodePoints(t, datagram)
+		assert.Equal(t, application, "app")
+		assert.Equal(t, len(points), 1)
+		assert.Equal(t, points[0].key, "a,scope=test value")
+	}
+
+	send()
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+	receive(conn)
+
+	// after the connection is lost, the sender reconnects and the packets
+	// are delivered on the new connection.
+	assert.NoError(t, conn.Close())
+	for i := 0; i < 10; i++ {
+		send()
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err = listener.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	receive(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, stream.Flush(ctx))
+	assert.Equal(t, stream.Dropped(), int64(0))
+}
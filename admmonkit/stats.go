@@ -0,0 +1,42 @@
+package admmonkit
+
+import (
+	"github.com/spacemonkeygo/monkit/v3"
+	"github.com/zeebo/admission/v3"
+)
+
+// DispatcherStats returns a monkit.StatSource that reports the statistics as
+// series with the measurement "admission_dispatcher", tagged with the name if
+// it is not empty. Chain it into a scope to have it sent along with the rest
+// of the registry, like
+//
+//	mon.Chain(admmonkit.DispatcherStats("collector", stats))
+func DispatcherStats(name string, stats *admission.Stats) monkit.StatSource {
+	key := monkit.NewSeriesKey("admission_dispatcher")
+	if name != "" {
+		key = key.WithTag("name", name)
+	}
+
+	return monkit.StatSourceFunc(func(cb func(key monkit.SeriesKey, field string, val float64)) {
+		snap := stats.Snapshot()
+		latency := &snap.HandlerLatency
+
+		cb(key, "packets", float64(snap.Packets))
+		cb(key, "batches", float64(snap.Batches))
+		cb(key, "average_batch", snap.AverageBatch())
+		cb(key, "average_fill", snap.AverageFill())
+		cb(key, "dropped", float64(snap.Dropped))
+		for reason, n := range snap.Drops {
+			cb(key, "dropped_"+admission.DropReason(reason).String(), float64(n))
+		}
+		cb(key, "read_errors", float64(snap.ReadErrors))
+		cb(key, "in_flight", float64(snap.InFlight))
+		cb(key, "max_in_flight", float64(snap.MaxInFlight))
+		cb(key, "handler_panics", float64(snap.Panics))
+		cb(key, "handler_count", float64(latency.Count()))
+		cb(key, "handler_mean", latency.Mean().Seconds())
+		cb(key, "handler_p50", latency.Quantile(0.5).Seconds())
+		cb(key, "handler_p90", latency.Quantile(0.9).Seconds())
+		cb(key, "handler_p99", latency.Quantile(0.99).Seconds())
+	})
+}
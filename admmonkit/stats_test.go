@@ -0,0 +1,36 @@
+package admmonkit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spacemonkeygo/monkit/v3"
+	"github.com/zeebo/admission/v3"
+	"github.com/zeebo/admission/v3/admtest"
+	"github.com/zeebo/assert"
+)
+
+func TestDispatcherStats(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+	stats := new(admission.Stats)
+
+	conn.Send([]byte("a"))
+	conn.Send([]byte("b"))
+	assert.NoError(t, conn.Close())
+
+	err := admission.Dispatcher{Handler: handler, Source: conn, Stats: stats}.Run(context.Background())
+	assert.Error(t, err)
+	assert.NoError(t, handler.Wait(context.Background(), 2))
+
+	values := make(map[string]float64)
+	DispatcherStats("collector", stats).Stats(func(key monkit.SeriesKey, field string, val float64) {
+		values[key.WithField(field)] = val
+	})
+
+	assert.Equal(t, values["admission_dispatcher,name=collector packets"], 2.0)
+	assert.Equal(t, values["admission_dispatcher,name=collector batches"], 1.0)
+	assert.Equal(t, values["admission_dispatcher,name=collector read_errors"], 1.0)
+	assert.Equal(t, values["admission_dispatcher,name=collector dropped"], 0.0)
+	assert.Equal(t, values["admission_dispatcher,name=collector dropped_overloaded"], 0.0)
+}
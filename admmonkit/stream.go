@@ -0,0 +1,255 @@
+package admmonkit
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zeebo/admission/v3/admproto"
+)
+
+const (
+	// DefaultStreamBuffer is the number of bytes of packets a StreamSender
+	// holds on to while it is unable to send them.
+	DefaultStreamBuffer = 1 << 20
+
+	// streamMinBackoff and streamMaxBackoff bound the time between attempts
+	// to reconnect.
+	streamMinBackoff = 100 * time.Millisecond
+	streamMaxBackoff = 10 * time.Second
+)
+
+// StreamSender sends packets over a TCP connection as length prefixed frames.
+// It connects in the background, reconnecting whenever the connection fails,
+// and holds on to a bounded number of bytes of packets until they can be sent.
+// When the buffer is full, the oldest packets are dropped. It is safe for
+// concurrent use.
+type StreamSender struct {
+	address string
+	buffer  int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	conn    net.Conn
+	queue   [][]byte
+	queued  int
+	dropped int64
+	closed  bool
+
+	ctx    context.Context
+	cancel func()
+	done   chan struct{}
+}
+
+// NewStreamSender returns a StreamSender that sends packets to the TCP address,
+// holding on to at most buffer bytes of packets that have not been sent. If
+// buffer is zero, DefaultStreamBuffer is used.
+func NewStreamSender(address string, buffer int) *StreamSender {
+	if buffer == 0 {
+		buffer = DefaultStreamBuffer
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &StreamSender{
+		address: address,
+		buffer:  buffer,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	go s.run()
+	return s
+}
+
+// Write queues the datagram, which is a packet with its checksum, to be sent.
+// It never blocks on the network. It implements io.Writer.
+func (s *StreamSender) Write(datagram []byte) (int, error) {
+	frame, err := admproto.AppendFrame(nil, datagram)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, Error.New("stream sender closed")
+	}
+
+	s.queue = append(s.queue, frame)
+	s.queued += len(frame)
+	for s.queued > s.buffer && len(s.queue) > 1 {
+		s.queued -= len(s.queue[0])
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.dropped++
+	}
+	s.cond.Broadcast()
+
+	return len(datagram), nil
+}
+
+// Dropped returns the number of packets that have been dropped because the
+// buffer was full.
+func (s *StreamSender) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+// Flush waits until every queued packet has been written to the connection or
+// the context is done.
+func (s *StreamSender) Flush(ctx context.Context) error {
+	// wake up the waiters when the context is done so they can check it.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.queue) > 0 && !s.closed {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.cond.Wait()
+	}
+	return nil
+}
+
+// Close stops the StreamSender and closes its connection. Any packets that
+// have not been sent are dropped.
+func (s *StreamSender) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		s.cancel()
+		s.cond.Broadcast()
+		if s.conn != nil {
+			_ = s.conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	<-s.done
+	return nil
+}
+
+// next waits for a frame to send and returns it without removing it from the
+// queue. It returns false if the sender is closed.
+func (s *StreamSender) next() ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.queue) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil, false
+	}
+	return s.queue[0], true
+}
+
+// sent removes the frame from the front of the queue if it is still there.
+func (s *StreamSender) sent(frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) > 0 && &s.queue[0][0] == &frame[0] {
+		s.queued -= len(frame)
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+	}
+	s.cond.Broadcast()
+}
+
+// run is the background goroutine that connects and writes frames.
+func (s *StreamSender) run() {
+	defer close(s.done)
+
+	var conn net.Conn
+	defer func() { _ = s.setConn(nil) }()
+
+	backoff := streamMinBackoff
+	for {
+		frame, ok := s.next()
+		if !ok {
+			return
+		}
+
+		if conn == nil {
+			var err error
+			var dialer net.Dialer
+			conn, err = dialer.DialContext(s.ctx, "tcp", s.address)
+			if err != nil {
+				log.Println("failed to connect stream:", err)
+				if !s.sleep(backoff) {
+					return
+				}
+				if backoff *= 2; backoff > streamMaxBackoff {
+					backoff = streamMaxBackoff
+				}
+				continue
+			}
+			backoff = streamMinBackoff
+
+			if !s.setConn(conn) {
+				return
+			}
+		}
+
+		if _, err := conn.Write(frame); err != nil {
+			log.Println("failed to send stream packet:", err)
+			_ = s.setConn(nil)
+			conn = nil
+			continue
+		}
+
+		s.sent(frame)
+	}
+}
+
+// setConn replaces the current connection, closing the old one. It closes the
+// new one and returns false if the sender was closed.
+func (s *StreamSender) setConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	s.conn = conn
+
+	if s.closed && conn != nil {
+		_ = conn.Close()
+		s.conn = nil
+		return false
+	}
+	return true
+}
+
+// sleep waits for the duration, returning false if the sender was closed.
+func (s *StreamSender) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,113 @@
+package admmonkit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/assert"
+)
+
+// closedAddress returns a local TCP address that refuses connections.
+func closedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := listener.Addr().String()
+	assert.NoError(t, listener.Close())
+	return addr
+}
+
+// waitClose closes the sender, failing if it does not stop in time.
+func waitClose(t *testing.T, s *StreamSender) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Close()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out closing the stream sender")
+	}
+}
+
+func TestStreamSender_Dropped(t *testing.T) {
+	addr := closedAddress(t)
+
+	var datagrams [][]byte
+	for _, packet := range []string{"1", "2", "3", "4", "5"} {
+		datagrams = append(datagrams, admproto.AddChecksum([]byte(packet)))
+	}
+
+	// the buffer holds three of the frames, which are the datagram and a
+	// four byte length.
+	s := NewStreamSender(addr, 3*(4+len(datagrams[0])))
+	defer waitClose(t, s)
+
+	for _, datagram := range datagrams {
+		_, err := s.Write(datagram)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, s.Dropped(), int64(2))
+
+	// once something is listening, only the newest frames are delivered.
+	listener, err := net.Listen("tcp", addr)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	buf := make([]byte, 64)
+	for _, datagram := range datagrams[2:] {
+		got, err := admproto.ReadFrame(conn, buf)
+		assert.NoError(t, err)
+		assert.DeepEqual(t, got, datagram)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Flush(ctx))
+	assert.Equal(t, s.Dropped(), int64(2))
+}
+
+func TestStreamSender_CloseDisconnected(t *testing.T) {
+	// the sender is backing off from failed connections.
+	s := NewStreamSender(closedAddress(t), 64)
+	_, err := s.Write([]byte("data"))
+	assert.NoError(t, err)
+	time.Sleep(3 * streamMinBackoff)
+	waitClose(t, s)
+
+	_, err = s.Write([]byte("data"))
+	assert.Error(t, err)
+
+	// flushing a closed sender does not wait for the dropped packets.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Flush(ctx))
+}
+
+func TestStreamSender_CloseNotAccepted(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	// the listener never accepts, so once the socket buffers fill up the
+	// sender is stuck writing and the rest of the packets are dropped.
+	s := NewStreamSender(listener.Addr().String(), 1<<16)
+	datagram := make([]byte, 1024)
+	for i := 0; i < 1<<14; i++ {
+		_, err := s.Write(datagram)
+		assert.NoError(t, err)
+	}
+	assert.That(t, s.Dropped() > 0)
+	waitClose(t, s)
+}
@@ -50,14 +50,89 @@ func consume(in []byte, n int) (out, data []byte, err error) {
 	return in[n:], in[:n], nil
 }
 
+// appendVarint appends x to the buffer as an unsigned varint.
+func appendVarint(in []byte, x uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], x)
+	return append(in, scratch[:n]...)
+}
+
+// consumeVarint attempts to read an unsigned varint from the buffer.
+func consumeVarint(in []byte) (out []byte, x uint64, err error) {
+	x, n := binary.Uvarint(in)
+	if n <= 0 {
+		return nil, 0, bufferTooSmall
+	}
+	return in[n:], x, nil
+}
+
+// consumeLength attempts to read a length prefix from the buffer. The length
+// is a single byte in the old format and a varint when varint is true.
+func consumeLength(in []byte, varint bool) (out []byte, n int, err error) {
+	if !varint {
+		in, length, err := consume(in, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		return in, int(length[0]), nil
+	}
+
+	in, x, err := consumeVarint(in)
+	if err != nil {
+		return nil, 0, err
+	}
+	// no length or count can be larger than the buffer it is contained in.
+	if x > uint64(len(in)) {
+		return nil, 0, bufferTooSmall
+	}
+	return in, int(x), nil
+}
+
 // a list of versions and what they mean
 const (
 	floatMask      byte = 0b11 // mask to select the float encoding version
 	float16Version byte = 0b00 // incenc encoded keys with float16 values
 	float32Version byte = 0b01 // incenc encoded keys with float32 values
 	float64Version byte = 0b10 // incenc encoded keys with float64 values
+	floatExtended  byte = 0b11 // a float encoding byte follows the version
 
 	headerMask      byte = 0b100 // mask to select the header's included version
 	headersExcluded byte = 0b000 // headers are not included in the packet
 	headersIncluded byte = 0b100 // headers are included in the packet
+
+	lengthMask    byte = 0b1000 // mask to select the length encoding version
+	lengthsByte   byte = 0b0000 // lengths in the header are single bytes
+	lengthsVarint byte = 0b1000 // lengths in the header are varints
+
+	labelMask      byte = 0b10000 // mask to select the label included version
+	labelsExcluded byte = 0b00000 // points do not have labels
+	labelsIncluded byte = 0b10000 // every point has a label set
+
+	kindMask      byte = 0b100000 // mask to select the point kind version
+	kindsExcluded byte = 0b000000 // every point is a float
+	kindsIncluded byte = 0b100000 // every point starts its value with a Kind
+
+	frameMask       byte = 0b11000000 // mask to select the Frame version
+	framesStateless byte = 0b00000000 // values are absolute and need no state
+	framesKeyframe  byte = 0b01000000 // values are absolute and form a base
+	framesDelta     byte = 0b10000000 // float values start with a delta flag
+
+	// every bit of the version is in use, so the unused Frame version is
+	// reserved as an escape: a version with it set is in some future format
+	// that describes itself with the bytes that follow, and the rest of the
+	// bits mean nothing in this one.
+	formatEscape byte = 0b11000000
+)
+
+// a list of float encodings that follow a floatExtended version and what they
+// mean
+const (
+	bfloat16Version byte = 0 // bfloat16 values
+	fixedVersion    byte = 1 // varint values scaled by a power of ten byte that follows
+)
+
+// a list of flags that start float values in delta frames and what they mean
+const (
+	absoluteValue byte = 0 // the value is absolute
+	deltaValue    byte = 1 // the value is the difference from the keyframe
 )
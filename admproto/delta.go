@@ -0,0 +1,173 @@
+package admproto
+
+import (
+	"sync"
+)
+
+// Frame describes how the values in a packet relate to earlier packets.
+type Frame byte
+
+const ( // an enumeration of all of the Frames.
+	// StatelessFrame packets have absolute values and need no state.
+	StatelessFrame Frame = iota
+
+	// Keyframe packets have absolute values that later delta frames of the
+	// same generation are encoded against.
+	Keyframe
+
+	// DeltaFrame packets have values that are either absolute or the
+	// difference from the value in the keyframe of the same generation.
+	DeltaFrame
+)
+
+// DeltaState is the sender side of delta encoding. It remembers the values
+// sent in the most recent keyframe so that later frames only need to send the
+// differences. A frame is all of the packets sent between calls to Advance. It
+// is not safe for concurrent use, and must only be used by one Writer at a
+// time.
+type DeltaState struct {
+	interval   int
+	frames     int
+	generation uint64
+	keyframe   bool
+	base       map[string]float64
+	id         []byte
+}
+
+// NewDeltaState returns a DeltaState that sends a keyframe every interval
+// frames. An interval less than two sends only keyframes.
+func NewDeltaState(interval int) *DeltaState {
+	return &DeltaState{
+		interval: interval,
+		base:     make(map[string]float64),
+	}
+}
+
+// Advance starts a new frame and returns true if it is a keyframe. It must be
+// called before the first packet of every frame is written.
+func (d *DeltaState) Advance() (keyframe bool) {
+	if d.frames == 0 || d.frames >= d.interval {
+		d.frames = 1
+		d.generation++
+		d.keyframe = true
+		for id := range d.base {
+			delete(d.base, id)
+		}
+	} else {
+		d.frames++
+		d.keyframe = false
+	}
+	return d.keyframe
+}
+
+// RequestKeyframe causes the next call to Advance to start a keyframe. It can
+// be used when the receiver is known to have lost its state.
+func (d *DeltaState) RequestKeyframe() {
+	d.frames = 0
+}
+
+// frame returns the frame and generation for the packets being written.
+func (d *DeltaState) frame() (Frame, uint64) {
+	if d.keyframe {
+		return Keyframe, d.generation
+	}
+	return DeltaFrame, d.generation
+}
+
+// DeltaTable is the receiver side of delta encoding. It remembers the values
+// from the keyframes of every sender so that deltas can be turned back into
+// absolute values. It is safe for concurrent use.
+type DeltaTable struct {
+	mu      sync.Mutex
+	senders map[string]*deltaSender
+}
+
+// deltaSender is the state kept for a single application and instance id.
+type deltaSender struct {
+	generation uint64
+	base       map[string]float64
+}
+
+// NewDeltaTable returns an empty DeltaTable.
+func NewDeltaTable() *DeltaTable {
+	return &DeltaTable{senders: make(map[string]*deltaSender)}
+}
+
+// Resolve returns the absolute value for the point most recently returned by
+// the Reader's Next method, where application and instance_id are from the
+// Reader's Begin method. Keyframes update the table. It returns an error if
+// the value is a delta against a keyframe value that was never received.
+func (t *DeltaTable) Resolve(r *Reader, application, instance_id, key []byte, value float64) (
+	float64, error) {
+
+	frame, generation := r.Frame()
+	if frame == StatelessFrame || r.Kind() != FloatKind || (frame == DeltaFrame && !r.Delta()) {
+		return value, nil
+	}
+
+	var sender_scratch, id_scratch [256]byte
+	sender_id := appendSenderID(sender_scratch[:0], application, instance_id)
+	id := appendSeriesID(id_scratch[:0], string(key), r.Labels())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sender := t.senders[string(sender_id)]
+	if frame == Keyframe {
+		if sender == nil {
+			sender = &deltaSender{base: make(map[string]float64)}
+			t.senders[string(sender_id)] = sender
+		}
+		if sender.generation != generation {
+			sender.generation = generation
+			for id := range sender.base {
+				delete(sender.base, id)
+			}
+		}
+		sender.base[string(id)] = value
+		return value, nil
+	}
+
+	if sender == nil || sender.generation != generation {
+		return 0, Error.New("missing keyframe %d for %q", generation, key)
+	}
+	base, ok := sender.base[string(id)]
+	if !ok {
+		return 0, Error.New("missing keyframe value for %q", key)
+	}
+	return base + value, nil
+}
+
+// Forget removes all of the state for the application and instance id.
+func (t *DeltaTable) Forget(application, instance_id []byte) {
+	var scratch [256]byte
+	sender_id := appendSenderID(scratch[:0], application, instance_id)
+
+	t.mu.Lock()
+	delete(t.senders, string(sender_id))
+	t.mu.Unlock()
+}
+
+// appendSenderID appends a unique identifier for the application and instance
+// id to the buffer.
+func appendSenderID(in []byte, application, instance_id []byte) []byte {
+	in = appendVarint(in, uint64(len(application)))
+	in = append(in, application...)
+	in = appendVarint(in, uint64(len(instance_id)))
+	in = append(in, instance_id...)
+	return in
+}
+
+// appendSeriesID appends a unique identifier for the key and labels to the
+// buffer.
+func appendSeriesID(in []byte, key string, labels []Label) []byte {
+	in = appendVarint(in, uint64(len(key)))
+	in = append(in, key...)
+	for _, label := range labels {
+		in = appendVarint(in, uint64(len(label.Key)))
+		in = append(in, label.Key...)
+		in = appendVarint(in, uint64(len(label.Value)))
+		in = append(in, label.Value...)
+	}
+	return in
+}
@@ -0,0 +1,327 @@
+package admproto
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// Kind is the type of value carried by a point.
+type Kind byte
+
+const ( // an enumeration of all of the Kinds.
+	FloatKind Kind = iota
+	DistributionKind
+)
+
+const (
+	// MinDistributionScale is the smallest allowed Distribution scale. At this
+	// scale every bucket spans a factor of 2^1024.
+	MinDistributionScale = -10
+
+	// MaxDistributionScale is the largest allowed Distribution scale.
+	MaxDistributionScale = 20
+
+	// DefaultDistributionScale is a scale with buckets that span about 4.4%,
+	// keeping the error of any quantile under about 2.2%.
+	DefaultDistributionScale = 4
+)
+
+// Bucket is the number of observations that fell into a single bucket of a
+// Distribution.
+type Bucket struct {
+	Index int32
+	Count uint64
+}
+
+// Distribution is a sparse histogram with logarithmically sized buckets that
+// can be merged across instances. A positive observation v falls into the
+// bucket with index i where base^i < v <= base^(i+1) and base is
+// 2^(2^-Scale). Negative observations are bucketed by their magnitude. This is
+// the same bucketing as OpenTelemetry exponential histograms, so a
+// Distribution can be reduced to any smaller scale without losing counts.
+type Distribution struct {
+	// Scale controls the resolution of the buckets. Larger is finer.
+	Scale int8
+
+	// Sum is the sum of all of the observations.
+	Sum float64
+
+	// Zero is the number of observations equal to zero.
+	Zero uint64
+
+	// Positive are the buckets of positive observations sorted by index.
+	Positive []Bucket
+
+	// Negative are the buckets of the magnitudes of negative observations
+	// sorted by index.
+	Negative []Bucket
+}
+
+// NewDistribution returns an empty Distribution with the given scale.
+func NewDistribution(scale int) *Distribution {
+	return &Distribution{Scale: int8(scale)}
+}
+
+// Reset clears all of the observations while keeping the scale.
+func (d *Distribution) Reset() {
+	d.Sum = 0
+	d.Zero = 0
+	d.Positive = d.Positive[:0]
+	d.Negative = d.Negative[:0]
+}
+
+// Count returns the number of observations in the Distribution.
+func (d *Distribution) Count() uint64 {
+	count := d.Zero
+	for _, bucket := range d.Positive {
+		count += bucket.Count
+	}
+	for _, bucket := range d.Negative {
+		count += bucket.Count
+	}
+	return count
+}
+
+// Observe adds the value to the Distribution. Non-finite values are ignored.
+func (d *Distribution) Observe(value float64) {
+	switch {
+	case math.IsNaN(value) || math.IsInf(value, 0):
+		return
+	case value > 0:
+		d.Positive = addBucket(d.Positive, bucketIndex(value, d.Scale), 1)
+	case value < 0:
+		d.Negative = addBucket(d.Negative, bucketIndex(-value, d.Scale), 1)
+	default:
+		d.Zero++
+	}
+	d.Sum += value
+}
+
+// Merge adds all of the observations in other into the Distribution. If the
+// scales differ, the result has the smaller of the two.
+func (d *Distribution) Merge(other *Distribution) {
+	if other.Scale < d.Scale {
+		d.downscale(d.Scale - other.Scale)
+	}
+	shift := uint(other.Scale - d.Scale)
+
+	for _, bucket := range other.Positive {
+		d.Positive = addBucket(d.Positive, bucket.Index>>shift, bucket.Count)
+	}
+	for _, bucket := range other.Negative {
+		d.Negative = addBucket(d.Negative, bucket.Index>>shift, bucket.Count)
+	}
+	d.Zero += other.Zero
+	d.Sum += other.Sum
+}
+
+// Quantile returns an approximation of the value at the quantile, where
+// 0 <= quantile <= 1. It returns zero if there are no observations.
+func (d *Distribution) Quantile(quantile float64) float64 {
+	count := d.Count()
+	if count == 0 {
+		return 0
+	}
+
+	rank := uint64(quantile * float64(count-1))
+	if quantile <= 0 {
+		rank = 0
+	} else if rank >= count {
+		rank = count - 1
+	}
+
+	for i := len(d.Negative) - 1; i >= 0; i-- {
+		if rank < d.Negative[i].Count {
+			return -bucketValue(d.Negative[i].Index, d.Scale)
+		}
+		rank -= d.Negative[i].Count
+	}
+	if rank < d.Zero {
+		return 0
+	}
+	rank -= d.Zero
+	for _, bucket := range d.Positive {
+		if rank < bucket.Count {
+			return bucketValue(bucket.Index, d.Scale)
+		}
+		rank -= bucket.Count
+	}
+
+	// unreachable because rank < count.
+	return 0
+}
+
+// downscale reduces the scale of the Distribution by the amount, merging
+// buckets as necessary.
+func (d *Distribution) downscale(by int8) {
+	d.Positive = shiftBuckets(d.Positive, uint(by))
+	d.Negative = shiftBuckets(d.Negative, uint(by))
+	d.Scale -= by
+}
+
+// validate checks that the Distribution can be encoded.
+func (d *Distribution) validate() error {
+	if d.Scale < MinDistributionScale || d.Scale > MaxDistributionScale {
+		return Error.New("invalid distribution scale: %d", d.Scale)
+	}
+	if !sortedBuckets(d.Positive) || !sortedBuckets(d.Negative) {
+		return Error.New("distribution buckets are not sorted")
+	}
+	return nil
+}
+
+// bucketIndex returns the index of the bucket that the positive value falls
+// into at the scale.
+func bucketIndex(value float64, scale int8) int32 {
+	return int32(math.Ceil(math.Ldexp(math.Log2(value), int(scale)))) - 1
+}
+
+// bucketValue returns a representative value for the bucket at the index at
+// the scale. It is the geometric midpoint of the bucket's bounds.
+func bucketValue(index int32, scale int8) float64 {
+	return math.Exp2(math.Ldexp(float64(index)+0.5, -int(scale)))
+}
+
+// addBucket adds count to the bucket with the index, keeping the buckets
+// sorted.
+func addBucket(buckets []Bucket, index int32, count uint64) []Bucket {
+	i := sort.Search(len(buckets), func(i int) bool { return buckets[i].Index >= index })
+	if i < len(buckets) && buckets[i].Index == index {
+		buckets[i].Count += count
+		return buckets
+	}
+	buckets = append(buckets, Bucket{})
+	copy(buckets[i+1:], buckets[i:])
+	buckets[i] = Bucket{Index: index, Count: count}
+	return buckets
+}
+
+// shiftBuckets reduces the indexes of the sorted buckets by the shift, merging
+// any that end up with the same index.
+func shiftBuckets(buckets []Bucket, shift uint) []Bucket {
+	out := buckets[:0]
+	for _, bucket := range buckets {
+		bucket.Index >>= shift
+		if len(out) > 0 && out[len(out)-1].Index == bucket.Index {
+			out[len(out)-1].Count += bucket.Count
+		} else {
+			out = append(out, bucket)
+		}
+	}
+	return out
+}
+
+// sortedBuckets returns true if the bucket indexes are strictly increasing.
+func sortedBuckets(buckets []Bucket) bool {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].Index <= buckets[i-1].Index {
+			return false
+		}
+	}
+	return true
+}
+
+// appendDistribution appends the Distribution to the buffer. The first bucket
+// index of each set is written as a signed varint and the rest as the
+// difference from the previous index.
+func appendDistribution(in []byte, d *Distribution) []byte {
+	var scratch [8]byte
+	binary.BigEndian.PutUint64(scratch[:], math.Float64bits(d.Sum))
+
+	in = append(in, byte(d.Scale))
+	in = append(in, scratch[:]...)
+	in = appendVarint(in, d.Zero)
+	in = appendBuckets(in, d.Positive)
+	in = appendBuckets(in, d.Negative)
+	return in
+}
+
+// appendBuckets appends the sorted buckets to the buffer.
+func appendBuckets(in []byte, buckets []Bucket) []byte {
+	in = appendVarint(in, uint64(len(buckets)))
+	for i, bucket := range buckets {
+		if i == 0 {
+			var scratch [binary.MaxVarintLen64]byte
+			n := binary.PutVarint(scratch[:], int64(bucket.Index))
+			in = append(in, scratch[:n]...)
+		} else {
+			in = appendVarint(in, uint64(int64(bucket.Index)-int64(buckets[i-1].Index)))
+		}
+		in = appendVarint(in, bucket.Count)
+	}
+	return in
+}
+
+// consumeDistribution reads a Distribution written by appendDistribution from
+// the buffer into d, reusing its storage.
+func consumeDistribution(in []byte, d *Distribution) (out []byte, err error) {
+	in, data, err := consume(in, 9)
+	if err != nil {
+		return nil, err
+	}
+	d.Scale = int8(data[0])
+	d.Sum = math.Float64frombits(binary.BigEndian.Uint64(data[1:]))
+	if d.Scale < MinDistributionScale || d.Scale > MaxDistributionScale {
+		return nil, Error.New("invalid distribution scale: %d", d.Scale)
+	}
+
+	in, d.Zero, err = consumeVarint(in)
+	if err != nil {
+		return nil, err
+	}
+	in, d.Positive, err = consumeBuckets(in, d.Positive[:0])
+	if err != nil {
+		return nil, err
+	}
+	in, d.Negative, err = consumeBuckets(in, d.Negative[:0])
+	if err != nil {
+		return nil, err
+	}
+
+	return in, nil
+}
+
+// consumeBuckets reads buckets written by appendBuckets from the buffer and
+// appends them to buckets.
+func consumeBuckets(in []byte, buckets []Bucket) (out []byte, _ []Bucket, err error) {
+	in, count, err := consumeLength(in, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var index int64
+	for i := 0; i < count; i++ {
+		if i == 0 {
+			var n int
+			index, n = binary.Varint(in)
+			if n <= 0 {
+				return nil, nil, bufferTooSmall
+			}
+			in = in[n:]
+		} else {
+			var delta uint64
+			in, delta, err = consumeVarint(in)
+			if err != nil {
+				return nil, nil, err
+			}
+			if delta == 0 || delta > math.MaxUint32 {
+				return nil, nil, Error.New("invalid distribution bucket delta: %d", delta)
+			}
+			index += int64(delta)
+		}
+		if index < math.MinInt32 || index > math.MaxInt32 {
+			return nil, nil, Error.New("invalid distribution bucket: %d", index)
+		}
+
+		var bucket_count uint64
+		in, bucket_count, err = consumeVarint(in)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		buckets = append(buckets, Bucket{Index: int32(index), Count: bucket_count})
+	}
+
+	return in, buckets, nil
+}
@@ -14,10 +14,19 @@ const ( // an enumeration of all of the FloatEncodings.
 	Float16Encoding FloatEncoding = iota
 	Float32Encoding
 	Float64Encoding
+
+	// BFloat16Encoding keeps the range of a float32 with only about three
+	// significant digits of precision.
+	BFloat16Encoding
+
+	// FixedEncoding sends values as integers scaled by a power of ten given by
+	// the FixedExponent option, which is sent once per packet.
+	FixedEncoding
 )
 
-// append encodes the value and appends it to the passed in slice.
-func (f FloatEncoding) appendFloat(in []byte, value float64) (out []byte, err error) {
+// append encodes the value and appends it to the passed in slice. The exponent
+// is only used by the FixedEncoding.
+func (f FloatEncoding) appendFloat(in []byte, value float64, exponent int8) (out []byte, err error) {
 	switch f {
 	case Float16Encoding:
 		value16, ok := float16.FromFloat64(value)
@@ -40,13 +49,30 @@ func (f FloatEncoding) appendFloat(in []byte, value float64) (out []byte, err er
 			byte(fuint64>>24), byte(fuint64>>16),
 			byte(fuint64>>8), byte(fuint64)), nil
 
+	case BFloat16Encoding:
+		value16, ok := toBFloat16(value)
+		if !ok {
+			return nil, Error.New("value not representable in bfloat16")
+		}
+		return append(in, byte(value16>>8), byte(value16)), nil
+
+	case FixedEncoding:
+		mantissa, ok := toFixed(value, exponent)
+		if !ok {
+			return nil, Error.New("value not representable with exponent %d", exponent)
+		}
+		var scratch [binary.MaxVarintLen64]byte
+		n := binary.PutVarint(scratch[:], mantissa)
+		return append(in, scratch[:n]...), nil
+
 	default:
 		return nil, Error.New("unknown float encoding: %d", f)
 	}
 }
 
-// consumeFloat consumes the float value from in and retuns the slice.
-func (f FloatEncoding) consumeFloat(in []byte) (out []byte, value float64, err error) {
+// consumeFloat consumes the float value from in and retuns the slice. The
+// exponent is only used by the FixedEncoding.
+func (f FloatEncoding) consumeFloat(in []byte, exponent int8) (out []byte, value float64, err error) {
 	switch f {
 	case Float16Encoding:
 		in, data, err := consume(in, 2)
@@ -75,7 +101,69 @@ func (f FloatEncoding) consumeFloat(in []byte) (out []byte, value float64, err e
 
 		return in, value, nil
 
+	case BFloat16Encoding:
+		in, data, err := consume(in, 2)
+		if err != nil {
+			return nil, 0, err
+		}
+		value = float64(math.Float32frombits(uint32(data[1])<<16 | uint32(data[0])<<24))
+
+		return in, value, nil
+
+	case FixedEncoding:
+		mantissa, n := binary.Varint(in)
+		if n <= 0 {
+			return nil, 0, bufferTooSmall
+		}
+		value = fromFixed(mantissa, exponent)
+
+		return in[n:], value, nil
+
 	default:
 		return nil, 0, Error.New("unknown float encoding: %d", f)
 	}
 }
+
+// toBFloat16 returns the bfloat16 closest to the value, which is the top half
+// of the float32 bits rounded to nearest even. It returns false if the value
+// is too large in magnitude to represent.
+func toBFloat16(value float64) (x uint16, ok bool) {
+	value32 := float32(value)
+	if value32 != value32 {
+		return 0x7fc0, true
+	}
+
+	bits := math.Float32bits(value32)
+	bits += 0x7fff + (bits>>16)&1
+	x = uint16(bits >> 16)
+
+	// if the value became infinite during conversion or rounding, it was not
+	// infinite to begin with and is too large.
+	if x&0x7fff == 0x7f80 && !math.IsInf(value, 0) {
+		return 0, false
+	}
+	return x, true
+}
+
+// toFixed returns the integer closest to value / 10^exponent. It returns false
+// if the value is not finite or the integer does not fit in an int64.
+func toFixed(value float64, exponent int8) (mantissa int64, ok bool) {
+	var scaled float64
+	if exponent < 0 {
+		scaled = math.Round(value * math.Pow10(-int(exponent)))
+	} else {
+		scaled = math.Round(value / math.Pow10(int(exponent)))
+	}
+	if !(scaled >= math.MinInt64 && scaled < math.MaxInt64) {
+		return 0, false
+	}
+	return int64(scaled), true
+}
+
+// fromFixed returns the value of mantissa * 10^exponent.
+func fromFixed(mantissa int64, exponent int8) float64 {
+	if exponent < 0 {
+		return float64(mantissa) / math.Pow10(-int(exponent))
+	}
+	return float64(mantissa) * math.Pow10(int(exponent))
+}
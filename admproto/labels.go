@@ -0,0 +1,73 @@
+package admproto
+
+// Label is a key/value pair attached to a single point.
+type Label struct {
+	Key   string
+	Value string
+}
+
+// appendLabels appends the label set to the buffer. The set is encoded as the
+// number of leading labels it shares with last, followed by the remaining
+// labels, so that consecutive points with similar labels stay small.
+func appendLabels(in []byte, last, labels []Label) (out []byte) {
+	keep := 0
+	for keep < len(labels) && keep < len(last) && labels[keep] == last[keep] {
+		keep++
+	}
+
+	in = appendVarint(in, uint64(keep))
+	in = appendVarint(in, uint64(len(labels)-keep))
+	for _, label := range labels[keep:] {
+		in = appendVarint(in, uint64(len(label.Key)))
+		in = append(in, label.Key...)
+		in = appendVarint(in, uint64(len(label.Value)))
+		in = append(in, label.Value...)
+	}
+
+	return in
+}
+
+// consumeLabels reads a label set written by appendLabels from the buffer
+// using last as the previous point's labels. The returned labels reuse the
+// storage of last.
+func consumeLabels(in []byte, last []Label) (out []byte, labels []Label, err error) {
+	in, keep, err := consumeLength(in, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keep > len(last) {
+		return nil, nil, Error.New("label set refers to unknown labels")
+	}
+	labels = last[:keep]
+
+	in, count, err := consumeLength(in, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var length int
+	var key, value []byte
+	for i := 0; i < count; i++ {
+		in, length, err = consumeLength(in, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		in, key, err = consume(in, length)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		in, length, err = consumeLength(in, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		in, value, err = consume(in, length)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		labels = append(labels, Label{Key: string(key), Value: string(value)})
+	}
+
+	return in, labels, nil
+}
@@ -1,7 +1,11 @@
 package admproto
 
 import (
+	"bytes"
+	"io"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -104,4 +108,557 @@ func TestReaderWriter(t *testing.T) {
 	t.Run("Float64", func(t *testing.T) {
 		runTest(t, Options{FloatEncoding: Float64Encoding}, nil)
 	})
+	t.Run("BFloat16", func(t *testing.T) {
+		runTest(t, Options{FloatEncoding: BFloat16Encoding}, nil)
+	})
+	t.Run("Fixed", func(t *testing.T) {
+		runTest(t, Options{FloatEncoding: FixedEncoding, FixedExponent: -3},
+			map[string]string{
+				"asfd": "a",
+			})
+	})
+}
+
+func TestFloatEncodings(t *testing.T) {
+	runTest := func(t *testing.T, options Options, value, expected float64) {
+		var (
+			buf []byte
+			r   Reader
+			w   = NewWriterWith(options)
+			err error
+		)
+
+		buf, err = w.Begin(buf, "testapp", []byte("ins-id"), 0)
+		assertNoError(t, err)
+		buf, err = w.Append(buf, "key", value)
+		assertNoError(t, err)
+
+		buf, _, _, _, err = r.Begin(buf)
+		assertNoError(t, err)
+		_, _, got, err := r.Next(buf)
+		assertNoError(t, err)
+		if got != expected {
+			t.Fatalf("got %v expected %v", got, expected)
+		}
+	}
+
+	t.Run("BFloat16", func(t *testing.T) {
+		options := Options{FloatEncoding: BFloat16Encoding}
+		runTest(t, options, 1e30, 1.0002555517425873e30)
+		runTest(t, options, -3.14159, -3.140625)
+		runTest(t, options, 1.00390625, 1)
+		runTest(t, options, math.Inf(1), math.Inf(1))
+
+		w := NewWriterWith(options)
+		_, err := w.Append(nil, "key", 1e300)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("Fixed", func(t *testing.T) {
+		runTest(t, Options{FloatEncoding: FixedEncoding, FixedExponent: -2}, 1.23456, 1.23)
+		runTest(t, Options{FloatEncoding: FixedEncoding, FixedExponent: -2}, -1.005, -1)
+		runTest(t, Options{FloatEncoding: FixedEncoding, FixedExponent: 3}, 123456, 123000)
+		runTest(t, Options{FloatEncoding: FixedEncoding}, 1e15, 1e15)
+
+		w := NewWriterWith(Options{FloatEncoding: FixedEncoding})
+		_, err := w.Append(nil, "key", math.NaN())
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestReaderWriter_LongHeader(t *testing.T) {
+	var (
+		buf []byte
+		r   Reader
+		w   = NewWriterWith(Options{VarintLengths: true})
+		err error
+	)
+
+	application := strings.Repeat("a", 300)
+	instance_id := bytes.Repeat([]byte("i"), 400)
+	value := bytes.Repeat([]byte("v"), 500)
+	const num_headers = 300
+
+	buf, err = w.Begin(buf, application, instance_id, num_headers)
+	assertNoError(t, err)
+	for i := 0; i < num_headers; i++ {
+		buf, err = w.AppendHeader(buf, []byte("key"), value)
+		assertNoError(t, err)
+	}
+	buf, err = w.Append(buf, "hello", 1)
+	assertNoError(t, err)
+
+	buf, got_application, got_instance_id, got_num_headers, err := r.Begin(buf)
+	assertNoError(t, err)
+	if string(got_application) != application || !bytes.Equal(got_instance_id, instance_id) {
+		t.Fatal("failed on begin")
+	}
+	if got_num_headers != num_headers {
+		t.Fatal("wrong number of headers", got_num_headers)
+	}
+
+	var key, val []byte
+	for i := 0; i < got_num_headers; i++ {
+		buf, key, val, err = r.NextHeader(buf)
+		assertNoError(t, err)
+		if string(key) != "key" || !bytes.Equal(val, value) {
+			t.Fatal("failed on header", i)
+		}
+	}
+
+	buf, key, got_value, err := r.Next(buf)
+	assertNoError(t, err)
+	if string(key) != "hello" || got_value != 1 || len(buf) != 0 {
+		t.Fatal("failed", string(key), got_value)
+	}
+}
+
+func TestReader_ByteLengths(t *testing.T) {
+	// a packet in the original format, where every length is a single byte.
+	buf := []byte{
+		float32Version | headersIncluded | lengthsByte,
+		3, 'a', 'p', 'p',
+		3, 'i', 'n', 's',
+		1,
+		1, 'k', 2, 'v', 'v',
+		0, 5, 'h', 'e', 'l', 'l', 'o', 0x3f, 0x80, 0x00, 0x00,
+	}
+
+	var r Reader
+	buf, application, instance_id, num_headers, err := r.Begin(buf)
+	assertNoError(t, err)
+	if string(application) != "app" || string(instance_id) != "ins" || num_headers != 1 {
+		t.Fatal("failed on begin")
+	}
+
+	buf, key, val, err := r.NextHeader(buf)
+	assertNoError(t, err)
+	if string(key) != "k" || string(val) != "vv" {
+		t.Fatal("failed on header")
+	}
+
+	buf, key, value, err := r.Next(buf)
+	assertNoError(t, err)
+	if string(key) != "hello" || value != 1 || len(buf) != 0 {
+		t.Fatal("failed", string(key), value)
+	}
+}
+
+func TestWriter_ByteLengths(t *testing.T) {
+	var w Writer
+
+	// by default the header is readable by readers without varint lengths.
+	buf, err := w.Begin(nil, "app", []byte("ins"), 1)
+	assertNoError(t, err)
+	buf, err = w.AppendHeader(buf, []byte("k"), []byte("vv"))
+	assertNoError(t, err)
+	exp := []byte{
+		float16Version | headersIncluded | lengthsByte,
+		3, 'a', 'p', 'p',
+		3, 'i', 'n', 's',
+		1,
+		1, 'k', 2, 'v', 'v',
+	}
+	if !bytes.Equal(buf, exp) {
+		t.Fatalf("%x != %x", buf, exp)
+	}
+
+	// so lengths can not be larger than a byte.
+	if _, err := w.Begin(nil, strings.Repeat("a", 256), nil, 0); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := w.Begin(nil, "app", nil, 256); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := w.AppendHeader(nil, []byte("k"), bytes.Repeat([]byte("v"), 256)); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestReader_FormatEscape(t *testing.T) {
+	// versions with the escape are from a future format.
+	var r Reader
+	for _, version := range []byte{formatEscape, formatEscape | 0b111111} {
+		if _, _, _, _, err := r.Begin([]byte{version, 0, 0}); err == nil {
+			t.Fatalf("expected an error for %08b", version)
+		}
+	}
+}
+
+func TestReaderWriter_Labels(t *testing.T) {
+	var (
+		buf []byte
+		r   Reader
+		w   = NewWriterWith(Options{Labels: true})
+		err error
+	)
+
+	points := []struct {
+		key    string
+		labels []Label
+		value  float64
+	}{
+		{"requests", []Label{{"endpoint", "/a"}, {"status", "200"}}, 1},
+		{"requests", []Label{{"endpoint", "/a"}, {"status", "500"}}, 2},
+		{"requests", nil, 3},
+		{"latency", []Label{{"endpoint", "/b"}}, 4},
+		{"latency", []Label{{"endpoint", "/b"}}, 5},
+	}
+
+	buf, err = w.Begin(buf, "testapp", []byte("ins-id"), 0)
+	assertNoError(t, err)
+	for _, point := range points {
+		buf, err = w.AppendLabeled(buf, point.key, point.labels, point.value)
+		assertNoError(t, err)
+	}
+
+	t.Logf("%x", buf)
+
+	buf, _, _, _, err = r.Begin(buf)
+	assertNoError(t, err)
+
+	var key []byte
+	var value float64
+	for _, point := range points {
+		buf, key, value, err = r.Next(buf)
+		assertNoError(t, err)
+		if string(key) != point.key || value != point.value {
+			t.Fatal("failed", string(key), value)
+		}
+		if len(r.Labels()) != len(point.labels) {
+			t.Fatal("wrong labels", r.Labels())
+		}
+		for i, label := range r.Labels() {
+			if label != point.labels[i] {
+				t.Fatal("wrong labels", r.Labels())
+			}
+		}
+	}
+
+	if len(buf) != 0 {
+		t.Fatal("failed")
+	}
+}
+
+func TestWriter_LabelsDisabled(t *testing.T) {
+	var w Writer
+
+	buf, err := w.Begin(nil, "testapp", []byte("ins-id"), 0)
+	assertNoError(t, err)
+	_, err = w.AppendLabeled(buf, "key", []Label{{"a", "b"}}, 0)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestReaderWriter_Distribution(t *testing.T) {
+	var (
+		buf []byte
+		r   Reader
+		w   = NewWriterWith(Options{Labels: true, Distributions: true})
+		err error
+	)
+
+	dist := NewDistribution(DefaultDistributionScale)
+	for i := -100; i <= 1000; i++ {
+		dist.Observe(float64(i))
+	}
+
+	buf, err = w.Begin(buf, "testapp", []byte("ins-id"), 0)
+	assertNoError(t, err)
+	buf, err = w.Append(buf, "hello", 1)
+	assertNoError(t, err)
+	buf, err = w.AppendDistribution(buf, "hello.dist", []Label{{"a", "b"}}, dist)
+	assertNoError(t, err)
+	buf, err = w.Append(buf, "hello.world", 2)
+	assertNoError(t, err)
+
+	buf, _, _, _, err = r.Begin(buf)
+	assertNoError(t, err)
+
+	buf, key, value, err := r.Next(buf)
+	assertNoError(t, err)
+	if string(key) != "hello" || value != 1 || r.Kind() != FloatKind {
+		t.Fatal("failed", string(key), value)
+	}
+
+	buf, key, _, err = r.Next(buf)
+	assertNoError(t, err)
+	if string(key) != "hello.dist" || r.Kind() != DistributionKind {
+		t.Fatal("failed", string(key))
+	}
+	if !reflect.DeepEqual(r.Distribution(), dist) {
+		t.Fatal("distribution mismatch")
+	}
+	if len(r.Labels()) != 1 || r.Labels()[0] != (Label{"a", "b"}) {
+		t.Fatal("wrong labels", r.Labels())
+	}
+
+	buf, key, value, err = r.Next(buf)
+	assertNoError(t, err)
+	if string(key) != "hello.world" || value != 2 || r.Kind() != FloatKind {
+		t.Fatal("failed", string(key), value)
+	}
+
+	if len(buf) != 0 {
+		t.Fatal("failed")
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	fine := NewDistribution(8)
+	coarse := NewDistribution(2)
+	all := NewDistribution(2)
+
+	for i := 1; i <= 1000; i++ {
+		fine.Observe(float64(i))
+		all.Observe(float64(i))
+	}
+	for i := -1000; i <= 0; i++ {
+		coarse.Observe(float64(i))
+		all.Observe(float64(i))
+	}
+
+	fine.Merge(coarse)
+	if fine.Scale != 2 {
+		t.Fatal("wrong scale", fine.Scale)
+	}
+	if !reflect.DeepEqual(fine, all) {
+		t.Fatal("merged distribution mismatch")
+	}
+	if fine.Count() != 2001 || fine.Sum != 0 {
+		t.Fatal("wrong count or sum", fine.Count(), fine.Sum)
+	}
+
+	check := func(quantile, expected, error float64) {
+		t.Helper()
+		got := fine.Quantile(quantile)
+		if got < expected-error || got > expected+error {
+			t.Fatalf("quantile %v: got %v expected %v", quantile, got, expected)
+		}
+	}
+
+	check(0, -1000, 1000*0.1)
+	check(0.5, 0, 0)
+	check(0.75, 500, 500*0.1)
+	check(1, 1000, 1000*0.1)
+}
+
+func TestReaderWriter_Delta(t *testing.T) {
+	state := NewDeltaState(3)
+	table := NewDeltaTable()
+
+	type point struct {
+		key   string
+		value float64
+	}
+
+	send := func(points ...point) []byte {
+		w := NewWriterWith(Options{FloatEncoding: FixedEncoding, Delta: state})
+		buf, err := w.Begin(nil, "testapp", []byte("ins-id"), 0)
+		assertNoError(t, err)
+		for _, point := range points {
+			buf, err = w.Append(buf, point.key, point.value)
+			assertNoError(t, err)
+		}
+		return buf
+	}
+
+	receive := func(buf []byte, expected_frame Frame, points ...point) error {
+		var r Reader
+		buf, application, instance_id, _, err := r.Begin(buf)
+		assertNoError(t, err)
+		if frame, _ := r.Frame(); frame != expected_frame {
+			t.Fatal("wrong frame", frame)
+		}
+		for _, point := range points {
+			var key []byte
+			var value float64
+			buf, key, value, err = r.Next(buf)
+			assertNoError(t, err)
+			value, err = table.Resolve(&r, application, instance_id, key, value)
+			if err != nil {
+				return err
+			}
+			if string(key) != point.key || value != point.value {
+				t.Fatal("failed", string(key), value)
+			}
+		}
+		if len(buf) != 0 {
+			t.Fatal("failed")
+		}
+		return nil
+	}
+
+	w := NewWriterWith(Options{Delta: state})
+	if _, err := w.Begin(nil, "testapp", nil, 0); err == nil {
+		t.Fatal("expected an error before the first frame")
+	}
+
+	if !state.Advance() {
+		t.Fatal("expected a keyframe")
+	}
+	assertNoError(t, receive(send(point{"a", 1000}, point{"b", 2000}), Keyframe,
+		point{"a", 1000}, point{"b", 2000}))
+
+	if state.Advance() {
+		t.Fatal("expected a delta frame")
+	}
+	buf := send(point{"a", 1001}, point{"b", 2000}, point{"c", 5})
+	assertNoError(t, receive(buf, DeltaFrame,
+		point{"a", 1001}, point{"b", 2000}, point{"c", 5}))
+
+	// losing the keyframe means deltas cannot be resolved.
+	table.Forget([]byte("testapp"), []byte("ins-id"))
+	if receive(buf, DeltaFrame, point{"a", 1001}) == nil {
+		t.Fatal("expected an error")
+	}
+
+	if state.Advance() {
+		t.Fatal("expected a delta frame")
+	}
+	if !state.Advance() {
+		t.Fatal("expected a keyframe")
+	}
+	assertNoError(t, receive(send(point{"a", 7}), Keyframe, point{"a", 7}))
+}
+
+func TestReader_Options(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{FloatEncoding: Float32Encoding, VarintLengths: true},
+		{FloatEncoding: BFloat16Encoding, Labels: true},
+		{FloatEncoding: FixedEncoding, FixedExponent: -3, Distributions: true},
+	} {
+		w := NewWriterWith(opts)
+		buf, err := w.Begin(nil, "testapp", []byte("ins-id"), 0)
+		assertNoError(t, err)
+
+		var r Reader
+		_, _, _, _, err = r.Begin(buf)
+		assertNoError(t, err)
+		if got := r.Options(); got != opts {
+			t.Fatalf("got %+v, expected %+v", got, opts)
+		}
+	}
+}
+
+func TestRewriteHeaders(t *testing.T) {
+	state := NewDeltaState(3)
+	state.Advance()
+	state.Advance()
+
+	w := NewWriterWith(Options{FloatEncoding: FixedEncoding, FixedExponent: -2, Labels: true, Delta: state})
+	buf, err := w.Begin(nil, "testapp", []byte("ins-id"), 1)
+	assertNoError(t, err)
+	buf, err = w.AppendHeader(buf, []byte("dc"), []byte("old"))
+	assertNoError(t, err)
+	buf, err = w.AppendLabeled(buf, "a", []Label{{Key: "k", Value: "v"}}, 1.25)
+	assertNoError(t, err)
+	buf, err = w.Append(buf, "b", 2)
+	assertNoError(t, err)
+
+	headers := func(buf []byte) (out []Header, rest []byte) {
+		var r Reader
+		rest, application, instance_id, num_headers, err := r.Begin(buf)
+		assertNoError(t, err)
+		if string(application) != "testapp" || string(instance_id) != "ins-id" {
+			t.Fatal("wrong application or instance id")
+		}
+		if frame, _ := r.Frame(); frame != DeltaFrame {
+			t.Fatal("wrong frame", frame)
+		}
+		for i := 0; i < num_headers; i++ {
+			var key, value []byte
+			rest, key, value, err = r.NextHeader(rest)
+			assertNoError(t, err)
+			out = append(out, Header{Key: string(key), Value: string(value)})
+		}
+		return out, rest
+	}
+	_, points := headers(buf)
+
+	// the headers are replaced and the points are left alone.
+	want := []Header{{Key: "dc", Value: "new"}, {Key: "region", Value: "r1"}}
+	rewritten, err := RewriteHeaders(nil, buf, want)
+	assertNoError(t, err)
+	got, rest := headers(rewritten)
+	if !reflect.DeepEqual(got, want) || !bytes.Equal(rest, points) {
+		t.Fatal("rewrite failed", got)
+	}
+
+	// headers can be removed and added back.
+	rewritten, err = RewriteHeaders(nil, buf, nil)
+	assertNoError(t, err)
+	got, rest = headers(rewritten)
+	if len(got) != 0 || !bytes.Equal(rest, points) {
+		t.Fatal("rewrite failed", got)
+	}
+	rewritten, err = RewriteHeaders(nil, rewritten, []Header{{Key: "dc", Value: "old"}})
+	assertNoError(t, err)
+	if !bytes.Equal(rewritten, buf) {
+		t.Fatal("rewrite failed")
+	}
+
+	// byte lengths still limit the headers.
+	if _, err := RewriteHeaders(nil, buf, []Header{{Key: strings.Repeat("k", 256)}}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestFrames(t *testing.T) {
+	var stream []byte
+	var err error
+
+	datagrams := [][]byte{
+		AddChecksum([]byte("hello")),
+		AddChecksum(nil),
+		AddChecksum(bytes.Repeat([]byte("x"), 1000)),
+	}
+	for _, datagram := range datagrams {
+		stream, err = AppendFrame(stream, datagram)
+		assertNoError(t, err)
+	}
+
+	r := bytes.NewReader(stream)
+	buf := make([]byte, 1024)
+	for _, datagram := range datagrams {
+		got, err := ReadFrame(r, buf)
+		assertNoError(t, err)
+		if !bytes.Equal(got, datagram) {
+			t.Fatal("datagram mismatch")
+		}
+	}
+	if _, err := ReadFrame(r, buf); err != io.EOF {
+		t.Fatal("expected eof", err)
+	}
+
+	// frames too large for the buffer are skipped.
+	r = bytes.NewReader(stream)
+	for _, datagram := range datagrams {
+		got, err := ReadFrame(r, buf[:0:10])
+		if len(datagram) > 10 {
+			if err != ErrFrameTooLarge {
+				t.Fatal("expected frame too large", err)
+			}
+			continue
+		}
+		assertNoError(t, err)
+		if !bytes.Equal(got, datagram) {
+			t.Fatal("datagram mismatch")
+		}
+	}
+	if _, err := ReadFrame(r, buf); err != io.EOF {
+		t.Fatal("expected eof", err)
+	}
+
+	// corrupt data is an error.
+	stream[len(stream)-1] ^= 1
+	if _, err := ReadFrame(bytes.NewReader(stream[21:]), buf); err == nil {
+		t.Fatal("expected an error")
+	}
 }
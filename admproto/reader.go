@@ -8,6 +8,17 @@ import (
 type Reader struct {
 	r        incenc.Reader
 	encoding FloatEncoding
+	exponent int8
+	varint   bool
+	labeled  bool
+	labels   []Label
+	kinds    bool
+	kind     Kind
+	dist     Distribution
+
+	frame      Frame
+	generation uint64
+	delta      bool
 }
 
 // NewReaderWith returns a Reader with some given scratch space as a buffer to
@@ -20,6 +31,16 @@ func NewReaderWith(scratch []byte) Reader {
 func (r *Reader) Reset() {
 	r.r.Reset()
 	r.encoding = 0
+	r.exponent = 0
+	r.varint = false
+	r.labeled = false
+	r.labels = r.labels[:0]
+	r.kinds = false
+	r.kind = FloatKind
+	r.dist.Reset()
+	r.frame = StatelessFrame
+	r.generation = 0
+	r.delta = false
 }
 
 // Begin returns the header information out of the packet, and the remaining
@@ -30,6 +51,11 @@ func (r *Reader) Begin(in []byte) (out, application, instance_id []byte, num_hea
 		return nil, nil, nil, 0, Error.Wrap(err)
 	}
 
+	// a future format can not be read with any of the bits below.
+	if version[0]&frameMask == formatEscape {
+		return nil, nil, nil, 0, Error.New("unsupported format version: %d", version[0])
+	}
+
 	// determine the float encoding from the version
 	switch version[0] & floatMask {
 	case float16Version:
@@ -38,6 +64,11 @@ func (r *Reader) Begin(in []byte) (out, application, instance_id []byte, num_hea
 		r.encoding = Float32Encoding
 	case float64Version:
 		r.encoding = Float64Encoding
+	case floatExtended:
+		in, err = r.beginExtended(in)
+		if err != nil {
+			return nil, nil, nil, 0, Error.Wrap(err)
+		}
 	default:
 		return nil, nil, nil, 0, Error.New("unknown version: %d", version[0])
 	}
@@ -52,49 +83,128 @@ func (r *Reader) Begin(in []byte) (out, application, instance_id []byte, num_hea
 		return nil, nil, nil, 0, Error.New("unknown version: %d", version[0])
 	}
 
-	in, length, err := consume(in, 1)
+	// determine how lengths are encoded from the version
+	switch version[0] & lengthMask {
+	case lengthsByte:
+		r.varint = false
+	case lengthsVarint:
+		r.varint = true
+	default:
+		return nil, nil, nil, 0, Error.New("unknown version: %d", version[0])
+	}
+
+	// determine if points have labels from the version
+	switch version[0] & labelMask {
+	case labelsExcluded:
+		r.labeled = false
+	case labelsIncluded:
+		r.labeled = true
+	default:
+		return nil, nil, nil, 0, Error.New("unknown version: %d", version[0])
+	}
+
+	// determine if points have kinds from the version
+	switch version[0] & kindMask {
+	case kindsExcluded:
+		r.kinds = false
+	case kindsIncluded:
+		r.kinds = true
+	default:
+		return nil, nil, nil, 0, Error.New("unknown version: %d", version[0])
+	}
+
+	// determine how values relate to earlier packets from the version
+	switch version[0] & frameMask {
+	case framesStateless:
+		r.frame = StatelessFrame
+	case framesKeyframe:
+		r.frame = Keyframe
+	case framesDelta:
+		r.frame = DeltaFrame
+	default:
+		return nil, nil, nil, 0, Error.New("unknown version: %d", version[0])
+	}
+
+	r.generation = 0
+	if r.frame != StatelessFrame {
+		in, r.generation, err = consumeVarint(in)
+		if err != nil {
+			return nil, nil, nil, 0, Error.Wrap(err)
+		}
+	}
+
+	in, length, err := consumeLength(in, r.varint)
 	if err != nil {
 		return nil, nil, nil, 0, Error.Wrap(err)
 	}
-	in, application, err = consume(in, int(length[0]))
+	in, application, err = consume(in, length)
 	if err != nil {
 		return nil, nil, nil, 0, Error.Wrap(err)
 	}
 
-	in, length, err = consume(in, 1)
+	in, length, err = consumeLength(in, r.varint)
+	if err != nil {
+		return nil, nil, nil, 0, Error.Wrap(err)
+	}
+	in, instance_id, err = consume(in, length)
 	if err != nil {
 		return nil, nil, nil, 0, Error.Wrap(err)
 	}
-	in, instance_id, err = consume(in, int(length[0]))
 
 	if has_headers {
-		in, length, err = consume(in, 1)
+		in, num_headers, err = consumeLength(in, r.varint)
 		if err != nil {
 			return nil, nil, nil, 0, Error.Wrap(err)
 		}
-		num_headers = int(length[0])
 	}
 
-	return in, application, instance_id, num_headers, err
+	return in, application, instance_id, num_headers, nil
+}
+
+// beginExtended consumes the description of an extended float encoding.
+func (r *Reader) beginExtended(in []byte) (out []byte, err error) {
+	in, encoding, err := consume(in, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch encoding[0] {
+	case bfloat16Version:
+		r.encoding = BFloat16Encoding
+	case fixedVersion:
+		var exponent []byte
+		in, exponent, err = consume(in, 1)
+		if err != nil {
+			return nil, err
+		}
+		r.encoding = FixedEncoding
+		r.exponent = int8(exponent[0])
+	default:
+		return nil, Error.New("unknown float encoding version: %d", encoding[0])
+	}
+
+	return in, nil
 }
 
+// NextHeader consumes a header key and value from in and returns the rest of
+// the bytes as out.
 func (r *Reader) NextHeader(in []byte) (out, key, val []byte, err error) {
-	in, length, err := consume(in, 1)
+	in, length, err := consumeLength(in, r.varint)
 	if err != nil {
 		return nil, nil, nil, Error.Wrap(err)
 	}
 
-	in, key, err = consume(in, int(length[0]))
+	in, key, err = consume(in, length)
 	if err != nil {
 		return nil, nil, nil, Error.Wrap(err)
 	}
 
-	in, length, err = consume(in, 1)
+	in, length, err = consumeLength(in, r.varint)
 	if err != nil {
 		return nil, nil, nil, Error.Wrap(err)
 	}
 
-	in, val, err = consume(in, int(length[0]))
+	in, val, err = consume(in, length)
 	if err != nil {
 		return nil, nil, nil, Error.Wrap(err)
 	}
@@ -103,17 +213,107 @@ func (r *Reader) NextHeader(in []byte) (out, key, val []byte, err error) {
 }
 
 // Next consumes bytes from in, returns the key and value, and returns the rest
-// of the bytes as out.
+// of the bytes as out. If the point is a distribution, the value is zero and
+// the distribution is available from the Distribution method.
 func (r *Reader) Next(in []byte) (out, key []byte, value float64, err error) {
 	in, key, err = r.r.Next(in)
 	if err != nil {
 		return nil, nil, 0, err
 	}
 
-	in, value, err = r.encoding.consumeFloat(in)
-	if err != nil {
-		return nil, nil, 0, err
+	if r.labeled {
+		in, r.labels, err = consumeLabels(in, r.labels)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	r.kind = FloatKind
+	if r.kinds {
+		var kind []byte
+		in, kind, err = consume(in, 1)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		r.kind = Kind(kind[0])
+	}
+
+	switch r.kind {
+	case FloatKind:
+		r.delta = false
+		if r.frame == DeltaFrame {
+			var flag []byte
+			in, flag, err = consume(in, 1)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			switch flag[0] {
+			case absoluteValue:
+			case deltaValue:
+				r.delta = true
+			default:
+				return nil, nil, 0, Error.New("unknown value flag: %d", flag[0])
+			}
+		}
+
+		in, value, err = r.encoding.consumeFloat(in, r.exponent)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+	case DistributionKind:
+		r.delta = false
+		in, err = consumeDistribution(in, &r.dist)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+	default:
+		return nil, nil, 0, Error.New("unknown kind: %d", r.kind)
 	}
 
 	return in, key, value, nil
 }
+
+// Labels returns the labels of the point most recently returned by Next. It is
+// only valid until the next call to Next.
+func (r *Reader) Labels() []Label {
+	return r.labels
+}
+
+// Options returns the options the packet most recently begun was written with,
+// other than Delta, so that its points can be written again the same way.
+func (r *Reader) Options() Options {
+	return Options{
+		FloatEncoding: r.encoding,
+		FixedExponent: r.exponent,
+		Labels:        r.labeled,
+		Distributions: r.kinds,
+		VarintLengths: r.varint,
+	}
+}
+
+// Frame returns the Frame and generation of the packet most recently begun.
+// Values in delta frames can be turned back into absolute values with a
+// DeltaTable.
+func (r *Reader) Frame() (frame Frame, generation uint64) {
+	return r.frame, r.generation
+}
+
+// Delta returns true if the value of the point most recently returned by Next
+// is the difference from the value in the keyframe of the same generation.
+func (r *Reader) Delta() bool {
+	return r.delta
+}
+
+// Kind returns the Kind of the point most recently returned by Next.
+func (r *Reader) Kind() Kind {
+	return r.kind
+}
+
+// Distribution returns the distribution of the point most recently returned by
+// Next if its Kind is DistributionKind. It is only valid until the next call to
+// Next.
+func (r *Reader) Distribution() *Distribution {
+	return &r.dist
+}
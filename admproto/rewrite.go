@@ -0,0 +1,55 @@
+package admproto
+
+// Header is a key/value pair from the start of a packet.
+type Header struct {
+	Key   string
+	Value string
+}
+
+// RewriteHeaders appends the packet, which does not have its checksum, to out
+// with its headers replaced by the passed in ones. The points are copied
+// without being decoded, so it works for packets in any format, including
+// delta frames, whose values depend on earlier packets. The headers are
+// limited to 255 bytes unless the packet was written with the VarintLengths
+// option.
+func RewriteHeaders(out, in []byte, headers []Header) ([]byte, error) {
+	var r Reader
+	rest, _, instance_id, num_headers, err := r.Begin(in)
+	if err != nil {
+		return nil, err
+	}
+
+	// everything up to the end of the instance id is kept as it is. the
+	// instance id is a slice of in, so its end can be found from its capacity.
+	prefix := in[1 : cap(in)-cap(instance_id)+len(instance_id)]
+
+	for i := 0; i < num_headers; i++ {
+		rest, _, _, err = r.NextHeader(rest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w := Writer{options: Options{VarintLengths: r.varint}}
+	if !r.varint && len(headers) > 255 {
+		return nil, Error.New("too many headers")
+	}
+
+	version := in[0] &^ headerMask
+	if len(headers) > 0 {
+		version |= headersIncluded
+	}
+
+	out = append(out, version)
+	out = append(out, prefix...)
+	if len(headers) > 0 {
+		out = w.appendLength(out, len(headers))
+	}
+	for _, header := range headers {
+		out, err = w.AppendHeader(out, []byte(header.Key), []byte(header.Value))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(out, rest...), nil
+}
@@ -0,0 +1,71 @@
+package admproto
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+// MaxFrameSize is the largest datagram that can be framed for a stream.
+const MaxFrameSize = 1 << 20
+
+// ErrFrameTooLarge is returned by ReadFrame when a frame does not fit in the
+// buffer. The frame has been skipped, so the next frame can still be read.
+var ErrFrameTooLarge = Error.New("frame too large for buffer")
+
+// AppendFrame appends the datagram with a length prefix to the buffer so that
+// it can be sent over a stream. The datagram is a packet with its checksum, as
+// returned by AddChecksum, so the frame is protected by the same checksum.
+func AppendFrame(buf, datagram []byte) ([]byte, error) {
+	if len(datagram) > MaxFrameSize {
+		return nil, Error.New("datagram too large: %d", len(datagram))
+	}
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], uint32(len(datagram)))
+	buf = append(buf, scratch[:]...)
+	return append(buf, datagram...), nil
+}
+
+// ReadFrame reads a frame written by AppendFrame from the reader into the
+// buffer's storage and returns the datagram, which is exactly what would have
+// been sent as a datagram over a socket. It errors if the datagram is larger
+// than MaxFrameSize or if its checksum does not match. If the datagram does not
+// fit in the buffer's capacity, it is skipped and ErrFrameTooLarge is returned.
+// It returns io.EOF only if the reader ends cleanly between frames.
+func ReadFrame(r io.Reader, buf []byte) (datagram []byte, err error) {
+	var scratch [4]byte
+	if _, err := io.ReadFull(r, scratch[:]); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, Error.Wrap(err)
+	}
+
+	size := binary.BigEndian.Uint32(scratch[:])
+	if size > MaxFrameSize {
+		return nil, Error.New("frame too large: %d", size)
+	}
+	if int(size) > cap(buf) {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, Error.Wrap(err)
+		}
+		return nil, ErrFrameTooLarge
+	}
+
+	datagram = buf[:size]
+	if _, err := io.ReadFull(r, datagram); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, Error.Wrap(err)
+	}
+
+	if _, err := CheckChecksum(datagram); err != nil {
+		return nil, err
+	}
+
+	return datagram, nil
+}
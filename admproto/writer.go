@@ -1,6 +1,8 @@
 package admproto
 
 import (
+	"encoding/binary"
+
 	"github.com/zeebo/incenc"
 )
 
@@ -9,12 +11,38 @@ type Options struct {
 	// FloatEncoding is what kind of encoding to use for the floating point
 	// values. The default is to use float16.
 	FloatEncoding FloatEncoding
+
+	// FixedExponent is the power of ten that values are scaled by when using
+	// the FixedEncoding. For example, -2 keeps two decimal places.
+	FixedExponent int8
+
+	// Labels causes every point to carry a set of labels, allowing the use of
+	// AppendLabeled. Points added with Append carry an empty set.
+	Labels bool
+
+	// Distributions causes every point to carry its Kind, allowing the use
+	// of AppendDistribution.
+	Distributions bool
+
+	// VarintLengths causes the lengths of the application, instance id,
+	// headers and the number of headers to be encoded as varints so that they
+	// can be longer than 255 bytes. Readers from before varint lengths ignore
+	// the version bit for them and misdecode any length of 128 or more, so
+	// they must be upgraded before it is used. Without it, those lengths are
+	// single bytes.
+	VarintLengths bool
+
+	// Delta, if set, causes float values to be sent as differences from the
+	// values in the last keyframe recorded in the DeltaState. Advance must be
+	// called on it before the first packet of every frame.
+	Delta *DeltaState
 }
 
 // Writer is a type for encoding key/value pairs to a byte buffer.
 type Writer struct {
 	options Options
 	w       incenc.Writer
+	labels  []Label
 }
 
 // NewWriterWith returns a Writer with the passed in options rather than the
@@ -26,26 +54,43 @@ func NewWriterWith(options Options) Writer {
 // Reset clears the state of the Writer.
 func (w *Writer) Reset() {
 	w.w.Reset()
+	w.labels = w.labels[:0]
 }
 
-// Begin appends header information to the buffer.
+// Begin appends header information to the buffer. The application, instance
+// id and number of headers are limited to 255 unless the VarintLengths option
+// is set.
 func (w *Writer) Begin(in []byte, application string, instance_id []byte, num_headers int) (
 	out []byte, err error) {
 
-	// Check that length does not exceed 255 so we can encode the length in a single byte
-	if len(application) > 255 {
-		return nil, Error.New("application too long")
+	if num_headers < 0 {
+		return nil, Error.New("negative number of headers")
 	}
-	if len(instance_id) > 255 {
-		return nil, Error.New("instance_id too long")
+	if !w.options.VarintLengths {
+		// check that lengths do not exceed 255 so we can encode them in a
+		// single byte
+		if len(application) > 255 {
+			return nil, Error.New("application too long")
+		}
+		if len(instance_id) > 255 {
+			return nil, Error.New("instance_id too long")
+		}
+		if num_headers > 255 {
+			return nil, Error.New("too many headers")
+		}
 	}
-	if num_headers > 255 {
-		return nil, Error.New("too many headers")
+	if w.options.Delta != nil && w.options.Delta.generation == 0 {
+		return nil, Error.New("delta state has not been advanced")
 	}
 
-	var version byte
+	version := lengthsByte
+	if w.options.VarintLengths {
+		version = lengthsVarint
+	}
 
-	// signal what float encoding we're using
+	// signal what float encoding we're using. the extended encodings are
+	// described by bytes after the version.
+	var extended []byte
 	switch w.options.FloatEncoding {
 	case Float16Encoding:
 		version |= float16Version
@@ -53,6 +98,12 @@ func (w *Writer) Begin(in []byte, application string, instance_id []byte, num_he
 		version |= float32Version
 	case Float64Encoding:
 		version |= float64Version
+	case BFloat16Encoding:
+		version |= floatExtended
+		extended = []byte{bfloat16Version}
+	case FixedEncoding:
+		version |= floatExtended
+		extended = []byte{fixedVersion, byte(w.options.FixedExponent)}
 	default:
 		return nil, Error.New("unknown float encoding: %d", w.options.FloatEncoding)
 	}
@@ -64,46 +115,201 @@ func (w *Writer) Begin(in []byte, application string, instance_id []byte, num_he
 		version |= headersExcluded
 	}
 
+	// signal if every point has a label set
+	if w.options.Labels {
+		version |= labelsIncluded
+	} else {
+		version |= labelsExcluded
+	}
+
+	// signal if every point has a kind
+	if w.options.Distributions {
+		version |= kindsIncluded
+	} else {
+		version |= kindsExcluded
+	}
+
+	// signal how the values relate to earlier packets
+	var generation uint64
+	if w.options.Delta != nil {
+		var frame Frame
+		frame, generation = w.options.Delta.frame()
+		if frame == Keyframe {
+			version |= framesKeyframe
+		} else {
+			version |= framesDelta
+		}
+	} else {
+		version |= framesStateless
+	}
+
 	in = append(in, version)
-	in = append(in, byte(len(application)))
+	in = append(in, extended...)
+	if w.options.Delta != nil {
+		in = appendVarint(in, generation)
+	}
+	in = w.appendLength(in, len(application))
 	in = append(in, application...)
-	in = append(in, byte(len(instance_id)))
+	in = w.appendLength(in, len(instance_id))
 	in = append(in, instance_id...)
 
 	if num_headers > 0 {
-		in = append(in, byte(num_headers))
+		in = w.appendLength(in, num_headers)
 	}
 
 	return in, nil
 }
 
-// AppendHeader adds the key and value to the starting bytes of the packet
+// AppendHeader adds the key and value to the starting bytes of the packet.
+// They are limited to 255 bytes unless the VarintLengths option is set.
 func (w *Writer) AppendHeader(in, key, value []byte) (out []byte, err error) {
-	if len(key) > 255 {
-		return nil, Error.New("header key %s too long", key)
+	if !w.options.VarintLengths {
+		if len(key) > 255 {
+			return nil, Error.New("header key %s too long", key)
+		}
+		if len(value) > 255 {
+			return nil, Error.New("header value %s too long", value)
+		}
 	}
-	if len(value) > 255 {
-		return nil, Error.New("header value %s too long", value)
-	}
-	in = append(in, byte(len(key)))
+	in = w.appendLength(in, len(key))
 	in = append(in, key...)
-	in = append(in, byte(len(value)))
+	in = w.appendLength(in, len(value))
 	in = append(in, value...)
 	return in, nil
 }
 
+// appendLength appends a length in the header, which has already been checked
+// to fit, as a varint or a single byte depending on the options.
+func (w *Writer) appendLength(in []byte, n int) []byte {
+	if w.options.VarintLengths {
+		return appendVarint(in, uint64(n))
+	}
+	return append(in, byte(n))
+}
+
 // Append adds the key and value to the buffer using the last Append calls to
 // reduce the amount of data it needs to write.
 func (w *Writer) Append(in []byte, key string, value float64) (out []byte, err error) {
-	in, err = w.w.Append(in, key)
+	return w.AppendLabeled(in, key, nil, value)
+}
+
+// AppendLabeled is like Append except the point carries the set of labels.
+// The labels are encoded against the labels of the previous point, so passing
+// them in a consistent order, like sorted by key, reduces the amount of data
+// it needs to write. It is an error to pass labels unless the Labels option
+// is set.
+func (w *Writer) AppendLabeled(in []byte, key string, labels []Label, value float64) (
+	out []byte, err error) {
+
+	if len(labels) > 0 && !w.options.Labels {
+		return nil, Error.New("labels are not enabled")
+	}
+
+	if w.options.Delta != nil {
+		return w.appendDelta(in, key, labels, value)
+	}
+
+	// encode the value first so that a value that cannot be encoded does not
+	// leave the Writer with state that the Reader will never see.
+	var scratch [binary.MaxVarintLen64]byte
+	encoded, err := w.options.FloatEncoding.appendFloat(scratch[:0], value, w.options.FixedExponent)
 	if err != nil {
 		return nil, err
 	}
 
-	in, err = w.options.FloatEncoding.appendFloat(in, value)
+	in, err = w.appendKey(in, key, labels, FloatKind)
 	if err != nil {
 		return nil, err
 	}
 
+	return append(in, encoded...), nil
+}
+
+// appendDelta adds the key and value to the buffer using the DeltaState. In
+// keyframes the value is absolute and recorded as the base for the series. In
+// delta frames the value is the difference from the base, flagged as such, or
+// absolute if the series has no base.
+func (w *Writer) appendDelta(in []byte, key string, labels []Label, value float64) (
+	out []byte, err error) {
+
+	d := w.options.Delta
+	d.id = appendSeriesID(d.id[:0], key, labels)
+	base, has_base := d.base[string(d.id)]
+
+	var scratch [1 + binary.MaxVarintLen64]byte
+	encoded := scratch[:0]
+	if !d.keyframe {
+		if has_base {
+			value -= base
+			encoded = append(encoded, deltaValue)
+		} else {
+			encoded = append(encoded, absoluteValue)
+		}
+	}
+
+	encoded, err = w.options.FloatEncoding.appendFloat(encoded, value, w.options.FixedExponent)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err = w.appendKey(in, key, labels, FloatKind)
+	if err != nil {
+		return nil, err
+	}
+
+	// the base is what the receiver will decode, not the value passed in, so
+	// that rounding in the encoding does not accumulate.
+	if d.keyframe {
+		_, base, err = w.options.FloatEncoding.consumeFloat(encoded, w.options.FixedExponent)
+		if err != nil {
+			return nil, err
+		}
+		d.base[string(d.id)] = base
+	}
+
+	return append(in, encoded...), nil
+}
+
+// AppendDistribution adds the key and distribution to the buffer. It is an
+// error to call unless the Distributions option is set.
+func (w *Writer) AppendDistribution(in []byte, key string, labels []Label, dist *Distribution) (
+	out []byte, err error) {
+
+	if !w.options.Distributions {
+		return nil, Error.New("distributions are not enabled")
+	}
+	if len(labels) > 0 && !w.options.Labels {
+		return nil, Error.New("labels are not enabled")
+	}
+	if err := dist.validate(); err != nil {
+		return nil, err
+	}
+
+	in, err = w.appendKey(in, key, labels, DistributionKind)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendDistribution(in, dist), nil
+}
+
+// appendKey appends everything about a point that comes before its value.
+func (w *Writer) appendKey(in []byte, key string, labels []Label, kind Kind) (
+	out []byte, err error) {
+
+	in, err = w.w.Append(in, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.options.Labels {
+		in = appendLabels(in, w.labels, labels)
+		w.labels = append(w.labels[:0], labels...)
+	}
+
+	if w.options.Distributions {
+		in = append(in, byte(kind))
+	}
+
 	return in, nil
 }
@@ -0,0 +1,162 @@
+// package admtest provides in-memory replacements for sockets so that code
+// using a Dispatcher can be tested without the network.
+package admtest
+
+import (
+	"net"
+	"sync"
+
+	"github.com/zeebo/admission/v3/internal/batch"
+	"github.com/zeebo/errs"
+)
+
+// Error is the class of errors returned by this package.
+var Error = errs.Class("admtest")
+
+// ErrClosed is returned by reads on a closed Conn.
+var ErrClosed = Error.New("conn closed")
+
+// event is a single thing that happens to a read on a Conn.
+type event struct {
+	data   []byte
+	source net.Addr
+	err    error
+	wakeup bool
+}
+
+// Conn is an in-memory connection that can be used as the Source of a
+// Dispatcher. Packets, errors and spurious wakeups are queued with its methods
+// and are seen by reads in the order they were queued. It is safe for
+// concurrent use.
+type Conn struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	events  []event
+	closed  bool
+	reads   int
+	wakeups int
+}
+
+// NewConn returns an empty Conn.
+func NewConn() *Conn {
+	c := new(Conn)
+	c.cond.L = &c.mu
+	return c
+}
+
+// Send queues a packet with the data to be read. The data is copied.
+func (c *Conn) Send(data []byte) {
+	c.SendFrom(nil, data)
+}
+
+// SendFrom queues a packet with the data to be read as if it came from the
+// source address. The data is copied.
+func (c *Conn) SendFrom(source net.Addr, data []byte) {
+	c.push(event{data: append([]byte(nil), data...), source: source})
+}
+
+// Fail queues an error to be returned by a read. Packets queued before it are
+// read first.
+func (c *Conn) Fail(err error) {
+	c.push(event{err: err})
+}
+
+// Wakeup queues a spurious wakeup, like the one that happens when a socket is
+// reported as readable but the read returns EAGAIN. The read goes back to
+// waiting without returning.
+func (c *Conn) Wakeup() {
+	c.push(event{wakeup: true})
+}
+
+// Close causes any pending and future reads to return ErrClosed once the
+// queued events have been read.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.cond.Broadcast()
+	return nil
+}
+
+// Pending returns the number of queued events that have not been read.
+func (c *Conn) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.events)
+}
+
+// Reads returns the number of reads that have returned.
+func (c *Conn) Reads() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.reads
+}
+
+// Wakeups returns the number of spurious wakeups that reads have seen.
+func (c *Conn) Wakeups() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.wakeups
+}
+
+// push adds the event to the queue and wakes up any reads.
+func (c *Conn) push(ev event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.events = append(c.events, ev)
+	c.cond.Broadcast()
+}
+
+// ReadMessages implements admission.PacketSource. It waits for a packet, an
+// error, or for the Conn to be closed, and then fills in as many of the
+// Messages as it can with consecutive queued packets. Packets larger than the
+// Message buffer are truncated and marked as such, like they are by a socket.
+func (c *Conn) ReadMessages(msgs []*batch.Message) (n int, err error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		for len(c.events) > 0 && c.events[0].wakeup {
+			c.events = c.events[1:]
+			c.wakeups++
+		}
+		if len(c.events) > 0 || c.closed {
+			break
+		}
+		c.cond.Wait()
+	}
+	c.reads++
+
+	if len(c.events) == 0 {
+		return 0, ErrClosed
+	}
+	if ev := c.events[0]; ev.err != nil {
+		c.events = c.events[1:]
+		return 0, ev.err
+	}
+
+	for n < len(msgs) && len(c.events) > 0 {
+		ev := c.events[0]
+		if ev.err != nil || ev.wakeup {
+			break
+		}
+		c.events = c.events[1:]
+
+		m := msgs[n]
+		m.Data = m.Buffer()[:copy(m.Buffer(), ev.data)]
+		m.SetSource(ev.source)
+		m.SetTruncated(len(ev.data) > len(m.Data))
+		n++
+	}
+
+	return n, nil
+}
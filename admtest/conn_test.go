@@ -0,0 +1,75 @@
+package admtest
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/zeebo/admission/v3/internal/batch"
+	"github.com/zeebo/assert"
+)
+
+func TestConn(t *testing.T) {
+	conn := NewConn()
+	source := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}
+
+	conn.SendFrom(source, []byte("a"))
+	conn.Send(bytes.Repeat([]byte("b"), 2000))
+	conn.Wakeup()
+	conn.Send([]byte("c"))
+	assert.Equal(t, conn.Pending(), 4)
+
+	msgs := []*batch.Message{new(batch.Message), new(batch.Message)}
+
+	// reads stop at the size of the batch.
+	n, err := conn.ReadMessages(msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, n, 2)
+	assert.Equal(t, string(msgs[0].Data), "a")
+	assert.Equal(t, msgs[0].Source(), net.Addr(source))
+	assert.That(t, !msgs[0].Truncated())
+	assert.Equal(t, len(msgs[1].Data), len(msgs[1].Buffer()))
+	assert.That(t, msgs[1].Truncated())
+	assert.Nil(t, msgs[1].Source())
+
+	// wakeups are skipped.
+	n, err = conn.ReadMessages(msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+	assert.Equal(t, string(msgs[0].Data), "c")
+	assert.That(t, !msgs[0].Truncated())
+	assert.Equal(t, conn.Wakeups(), 1)
+	assert.Equal(t, conn.Reads(), 2)
+
+	// closing unblocks reads.
+	assert.NoError(t, conn.Close())
+	_, err = conn.ReadMessages(msgs)
+	assert.Equal(t, err, ErrClosed)
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	h := &Handler{Gate: make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m := new(batch.Message)
+		m.Data = []byte("a")
+		h.Handle(ctx, m)
+	}()
+
+	assert.NoError(t, h.WaitStarted(ctx, 1))
+	assert.Equal(t, len(h.Data()), 0)
+
+	h.Gate <- struct{}{}
+	assert.NoError(t, h.Wait(ctx, 1))
+	<-done
+	assert.DeepEqual(t, h.Data(), [][]byte{[]byte("a")})
+
+	// waiting gives up when the context is done.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Error(t, h.Wait(ctx, 2))
+}
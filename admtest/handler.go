@@ -0,0 +1,108 @@
+package admtest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/zeebo/admission/v3/internal/batch"
+)
+
+// Handler records the data of every Message it handles so that tests can
+// assert on them. It is safe for concurrent use.
+type Handler struct {
+	// Gate, if set, causes every call to Handle to wait for a value from it,
+	// or for the context to be done, before returning. It can be used to keep
+	// calls in flight.
+	Gate chan struct{}
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	started int
+	data    [][]byte
+}
+
+// Handle implements admission.Handler.
+func (h *Handler) Handle(ctx context.Context, m *batch.Message) {
+	h.mu.Lock()
+	h.init()
+	h.started++
+	h.cond.Broadcast()
+	h.mu.Unlock()
+
+	if h.Gate != nil {
+		select {
+		case <-h.Gate:
+		case <-ctx.Done():
+		}
+	}
+
+	h.mu.Lock()
+	h.data = append(h.data, append([]byte(nil), m.Data...))
+	h.cond.Broadcast()
+	h.mu.Unlock()
+}
+
+// init sets up the condition variable. It must be called with the mutex held.
+func (h *Handler) init() {
+	if h.cond.L == nil {
+		h.cond.L = &h.mu
+	}
+}
+
+// Started returns the number of calls to Handle that have started.
+func (h *Handler) Started() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.started
+}
+
+// Data returns the data of every Message that has been handled, in the order
+// the calls to Handle returned.
+func (h *Handler) Data() [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([][]byte(nil), h.data...)
+}
+
+// WaitStarted waits until at least n calls to Handle have started or the
+// context is done.
+func (h *Handler) WaitStarted(ctx context.Context, n int) error {
+	return h.wait(ctx, func() bool { return h.started >= n })
+}
+
+// Wait waits until at least n calls to Handle have returned or the context is
+// done.
+func (h *Handler) Wait(ctx context.Context, n int) error {
+	return h.wait(ctx, func() bool { return len(h.data) >= n })
+}
+
+// wait waits for the condition, which is checked with the mutex held.
+func (h *Handler) wait(ctx context.Context, cond func() bool) error {
+	// wake up the waiter when the context is done so it can check it.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.mu.Lock()
+			h.init()
+			h.cond.Broadcast()
+			h.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.init()
+
+	for !cond() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		h.cond.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package admission
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BatchHandler is a type that can handle many messages at once.
+type BatchHandler interface {
+	// HandleBatch should do things with the Data of the messages. Neither the
+	// slice nor any fields of the messages should be held on to after the
+	// call has returned unless the messages are kept with Retain, in which
+	// case Release must be called on each once it is no longer used.
+	HandleBatch(ctx context.Context, msgs []*Message)
+}
+
+// batchPool holds slices of messages for batches to avoid allocating one for
+// every call to the BatchHandler.
+var batchPool sync.Pool
+
+// getBatch returns an empty slice for a batch of up to size messages.
+func getBatch(size int) *[]*Message {
+	batch, _ := batchPool.Get().(*[]*Message)
+	if batch == nil || cap(*batch) < size {
+		msgs := make([]*Message, 0, size)
+		batch = &msgs
+	}
+	return batch
+}
+
+// putBatch clears the slice and returns it to the pool.
+func putBatch(batch *[]*Message) {
+	msgs := *batch
+	for i := range msgs {
+		msgs[i] = nil
+	}
+	*batch = msgs[:0]
+	batchPool.Put(batch)
+}
+
+// batcher collects messages into batches for the BatchHandler. Without a
+// window, it is only used by the Run loop, and batches are flushed after
+// every read. With a window, messages are sent to a goroutine that flushes
+// batches once they are full or the window has passed.
+type batcher struct {
+	d       *Dispatcher
+	sem     chan struct{}
+	lims    limits
+	size    int
+	pending *[]*Message
+
+	in   chan *Message
+	done chan struct{}
+}
+
+// newBatcher returns a batcher making batches of up to size messages,
+// starting its goroutine if the Dispatcher has a BatchWindow.
+func (d *Dispatcher) newBatcher(ctx context.Context, sem chan struct{}, lims limits, size int) *batcher {
+	b := &batcher{
+		d:       d,
+		sem:     sem,
+		lims:    lims,
+		size:    size,
+		pending: getBatch(size),
+	}
+	if d.BatchWindow > 0 {
+		b.in = make(chan *Message, size)
+		b.done = make(chan struct{})
+		go b.run(ctx, d.BatchWindow)
+	}
+	return b
+}
+
+// push adds the message to the next batch.
+func (b *batcher) push(ctx context.Context, m *Message) {
+	if b.in != nil {
+		b.in <- m
+		return
+	}
+	b.add(ctx, m)
+}
+
+// endRead is called after the messages from a read have been pushed.
+func (b *batcher) endRead(ctx context.Context) {
+	if b.in == nil {
+		b.flush(ctx)
+	}
+}
+
+// close handles the messages waiting for a batch, or drops them if the
+// context is done, and waits for the goroutine if there is one.
+func (b *batcher) close(ctx context.Context) {
+	if b.in != nil {
+		close(b.in)
+		<-b.done
+		return
+	}
+	b.finish(ctx)
+}
+
+// run collects the messages sent to the batcher until it is closed.
+func (b *batcher) run(ctx context.Context, window time.Duration) {
+	defer close(b.done)
+
+	// armed is true while the timer is running and its tick has not been
+	// received, so that it can always be stopped and drained before being
+	// reset, and a stale tick never flushes a batch early.
+	timer := time.NewTimer(window)
+	timer.Stop()
+	defer timer.Stop()
+	armed := false
+
+	for {
+		select {
+		case m, ok := <-b.in:
+			if !ok {
+				b.finish(ctx)
+				return
+			}
+			switch pending := b.add(ctx, m); {
+			case pending == 0 && armed:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				armed = false
+			case pending == 1 && !armed:
+				timer.Reset(window)
+				armed = true
+			}
+
+		case <-timer.C:
+			armed = false
+			b.flush(ctx)
+		}
+	}
+}
+
+// add adds the message to the pending batch, flushing it if it is full, and
+// returns how many messages are pending.
+func (b *batcher) add(ctx context.Context, m *Message) int {
+	*b.pending = append(*b.pending, m)
+	if len(*b.pending) >= b.size {
+		b.flush(ctx)
+	}
+	return len(*b.pending)
+}
+
+// flush passes the pending messages to the handler in a goroutine, or drops
+// them if too many calls are in flight.
+func (b *batcher) flush(ctx context.Context) {
+	if len(*b.pending) == 0 {
+		return
+	}
+
+	select {
+	case b.sem <- struct{}{}:
+		if b.d.Stats != nil {
+			b.d.Stats.start()
+		}
+		go b.d.handleBatch(ctx, b.sem, b.pending)
+		b.pending = getBatch(b.size)
+	default:
+		b.drop(ctx, DropOverloaded)
+	}
+}
+
+// finish flushes the pending messages unless the context is done, in which
+// case they are dropped.
+func (b *batcher) finish(ctx context.Context) {
+	if ctx.Err() != nil {
+		b.drop(ctx, DropShutdown)
+		return
+	}
+	b.flush(ctx)
+}
+
+// drop drops all of the pending messages for the reason.
+func (b *batcher) drop(ctx context.Context, reason DropReason) {
+	for _, m := range *b.pending {
+		if reason == DropOverloaded {
+			b.lims.refund(m)
+		}
+		b.d.dropMessage(ctx, reason, m)
+		m.Release()
+	}
+	putBatch(b.pending)
+	b.pending = getBatch(b.size)
+}
+
+// handleBatch passes the batch to the batch handler and releases the messages
+// once it is done, recording how long it took if there are stats.
+func (d *Dispatcher) handleBatch(ctx context.Context, sem chan struct{}, batch *[]*Message) {
+	var start time.Time
+	if d.Stats != nil {
+		start = time.Now()
+	}
+	defer func() {
+		<-sem
+		if d.Stats != nil {
+			d.Stats.done(time.Since(start))
+		}
+	}()
+
+	release := func() {
+		for _, m := range *batch {
+			m.Release()
+		}
+		putBatch(batch)
+	}
+
+	if d.RecoverPanics {
+		defer func() {
+			if value := recover(); value != nil {
+				if d.Stats != nil {
+					d.Stats.panicked()
+				}
+				// there is no single message for a batch, so the data
+				// is nil.
+				if d.Hooks.HandlerPanic != nil {
+					d.Hooks.HandlerPanic(ctx, value, nil)
+				}
+				release()
+			}
+		}()
+	}
+
+	d.BatchHandler.HandleBatch(ctx, *batch)
+	release()
+}
@@ -0,0 +1,195 @@
+package admission
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zeebo/admission/v3/admtest"
+	"github.com/zeebo/assert"
+)
+
+// batchRecorder records the data of every batch it handles, waiting on the
+// gate first if there is one.
+type batchRecorder struct {
+	gate    chan struct{}
+	handled chan struct{}
+
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func newBatchRecorder() *batchRecorder {
+	return &batchRecorder{handled: make(chan struct{}, 100)}
+}
+
+func (b *batchRecorder) HandleBatch(ctx context.Context, msgs []*Message) {
+	if b.gate != nil {
+		<-b.gate
+	}
+
+	datas := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		datas = append(datas, string(m.Data))
+	}
+
+	b.mu.Lock()
+	b.batches = append(b.batches, datas)
+	b.mu.Unlock()
+	b.handled <- struct{}{}
+}
+
+// wait waits for n more batches to be handled.
+func (b *batchRecorder) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-b.handled:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for a batch")
+		}
+	}
+}
+
+func (b *batchRecorder) recorded() [][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]string(nil), b.batches...)
+}
+
+func TestDispatcher_BatchHandler(t *testing.T) {
+	run := func(num_messages, batch_size, num_batches int) [][]string {
+		conn := admtest.NewConn()
+		handler := newBatchRecorder()
+		for _, data := range []string{"a", "b", "c", "d", "e"} {
+			conn.Send([]byte(data))
+		}
+		assert.NoError(t, conn.Close())
+
+		d := Dispatcher{
+			BatchHandler: handler,
+			BatchSize:    batch_size,
+			Source:       conn,
+			NumMessages:  num_messages,
+		}
+		assert.Error(t, d.Run(context.Background()))
+
+		// the batches are handled in parallel, so put them back in order.
+		handler.wait(t, num_batches)
+		batches := handler.recorded()
+		sort.Slice(batches, func(i, j int) bool { return batches[i][0] < batches[j][0] })
+		return batches
+	}
+
+	// batches are the messages from every read, which is the default size.
+	assert.DeepEqual(t, run(4, 0, 2), [][]string{{"a", "b", "c", "d"}, {"e"}})
+
+	// or are split up to the batch size.
+	assert.DeepEqual(t, run(5, 2, 3), [][]string{{"a", "b"}, {"c", "d"}, {"e"}})
+}
+
+func TestDispatcher_BatchWindow(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := newBatchRecorder()
+
+	d := Dispatcher{
+		BatchHandler: handler,
+		BatchSize:    10,
+		BatchWindow:  50 * time.Millisecond,
+		Source:       conn,
+		NumMessages:  1,
+	}
+	stop := runDispatcher(t, d, conn)
+
+	// the messages are read one at a time, but handled together.
+	conn.Send([]byte("a"))
+	conn.Send([]byte("b"))
+	conn.Send([]byte("c"))
+	handler.wait(t, 1)
+	assert.DeepEqual(t, handler.recorded(), [][]string{{"a", "b", "c"}})
+
+	// the window starts again with the next message.
+	conn.Send([]byte("d"))
+	handler.wait(t, 1)
+	assert.DeepEqual(t, handler.recorded(), [][]string{{"a", "b", "c"}, {"d"}})
+
+	assert.Error(t, stop())
+}
+
+func TestDispatcher_BatchWindowFull(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := newBatchRecorder()
+
+	d := Dispatcher{
+		BatchHandler: handler,
+		BatchSize:    2,
+		BatchWindow:  50 * time.Millisecond,
+		Source:       conn,
+		NumMessages:  1,
+	}
+	stop := runDispatcher(t, d, conn)
+
+	// full batches are flushed without waiting, and stop the window.
+	for i := 0; i < 10; i++ {
+		conn.Send([]byte("a"))
+		conn.Send([]byte("b"))
+		handler.wait(t, 1)
+	}
+
+	// the window starts again with the next message.
+	conn.Send([]byte("c"))
+	handler.wait(t, 1)
+
+	batches := handler.recorded()
+	assert.Equal(t, len(batches), 11)
+	for _, batch := range batches[:10] {
+		assert.DeepEqual(t, batch, []string{"a", "b"})
+	}
+	assert.DeepEqual(t, batches[10], []string{"c"})
+
+	assert.Error(t, stop())
+}
+
+func TestDispatcher_BatchDropped(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := newBatchRecorder()
+	handler.gate = make(chan struct{})
+	stats := new(Stats)
+	drops := new(dropRecorder)
+
+	d := Dispatcher{
+		BatchHandler: handler,
+		Source:       conn,
+		NumMessages:  2,
+		InFlight:     1,
+		Stats:        stats,
+	}
+	d.Hooks.Dropped = drops.dropped
+
+	// the first batch is stuck in the handler, so the second is dropped.
+	conn.Send([]byte("a"))
+	conn.Send([]byte("b"))
+	conn.Send([]byte("c"))
+	conn.Send([]byte("d"))
+	assert.NoError(t, conn.Close())
+
+	assert.Error(t, d.Run(context.Background()))
+	close(handler.gate)
+	handler.wait(t, 1)
+	waitIdle(stats)
+
+	assert.DeepEqual(t, handler.recorded(), [][]string{{"a", "b"}})
+	assert.Equal(t, drops.count(DropOverloaded), 2)
+	assert.Equal(t, stats.Snapshot().Drops[DropOverloaded], int64(2))
+}
+
+func TestDispatcher_BatchOrdering(t *testing.T) {
+	d := Dispatcher{
+		BatchHandler: newBatchRecorder(),
+		Source:       admtest.NewConn(),
+		Ordering:     OrderBySource,
+	}
+	assert.Error(t, d.Run(context.Background()))
+}
@@ -0,0 +1,283 @@
+package admission
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeebo/errs"
+)
+
+// captureMagic starts every capture and includes the version of the format.
+// It is followed by records of
+//
+//	8 bytes: big endian nanoseconds since the unix epoch it was received
+//	2 bytes: big endian length of the source
+//	source:  the network and address of the sender as network://address
+//	4 bytes: big endian length of the data
+//	data:    the raw bytes of the Message
+var captureMagic = []byte("admcap\x00\x01")
+
+// IsCapture returns true if the bytes are the start of a capture, and can be
+// used to tell captures apart from other formats.
+func IsCapture(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, captureMagic)
+}
+
+// Recorder is a Handler that writes every Message to a capture before passing
+// it on to the next Handler, if any. It is safe for concurrent use. Messages
+// are written in the order they are handled, which, with concurrent calls,
+// may differ from the order they were read.
+type Recorder struct {
+	next Handler
+
+	mu  sync.Mutex
+	bw  *bufio.Writer
+	err error
+	buf []byte
+}
+
+// NewRecorder writes the start of a capture to w and returns a Recorder that
+// appends to it. The next Handler may be nil.
+func NewRecorder(w io.Writer, next Handler) (*Recorder, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(captureMagic); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	return &Recorder{next: next, bw: bw}, nil
+}
+
+// Handle implements Handler by recording the message and then passing it on.
+func (r *Recorder) Handle(ctx context.Context, m *Message) {
+	r.record(time.Now(), m)
+	if r.next != nil {
+		r.next.Handle(ctx, m)
+	}
+}
+
+// record writes the message to the capture. After the first error, nothing
+// else is written.
+func (r *Recorder) record(now time.Time, m *Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+
+	var source string
+	if addr := m.Source(); addr != nil {
+		source = addr.Network() + "://" + addr.String()
+	}
+	if len(source) > 0xffff {
+		source = ""
+	}
+
+	buf := r.buf[:0]
+	buf = appendUint64(buf, uint64(now.UnixNano()))
+	buf = append(buf, byte(len(source)>>8), byte(len(source)))
+	buf = append(buf, source...)
+	buf = appendUint32(buf, uint32(len(m.Data)))
+	buf = append(buf, m.Data...)
+	r.buf = buf
+
+	if _, err := r.bw.Write(buf); err != nil {
+		r.err = errs.Wrap(err)
+	}
+}
+
+// Flush writes any buffered records to the underlying writer. It returns the
+// first error encountered writing the capture.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	if err := r.bw.Flush(); err != nil {
+		r.err = errs.Wrap(err)
+	}
+	return r.err
+}
+
+// CaptureReader reads the records of a capture.
+type CaptureReader struct {
+	br *bufio.Reader
+}
+
+// NewCaptureReader checks that r contains a capture and returns a
+// CaptureReader for the records in it.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, errs.Wrap(err)
+	}
+	if !IsCapture(magic) {
+		return nil, errs.New("not a capture")
+	}
+	return &CaptureReader{br: br}, nil
+}
+
+// Next reads the next record into the Message, setting its Data and source,
+// and returns when it was received. It returns io.EOF when there are no more
+// records.
+func (c *CaptureReader) Next(m *Message) (ts time.Time, err error) {
+	var hdr [10]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		if err == io.EOF {
+			return ts, err
+		}
+		return ts, errs.Wrap(err)
+	}
+	ts = time.Unix(0, int64(binary.BigEndian.Uint64(hdr[0:8])))
+
+	source := make([]byte, binary.BigEndian.Uint16(hdr[8:10]))
+	if _, err := io.ReadFull(c.br, source); err != nil {
+		return ts, errs.Wrap(noEOF(err))
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.br, size[:]); err != nil {
+		return ts, errs.Wrap(noEOF(err))
+	}
+	length := binary.BigEndian.Uint32(size[:])
+
+	buf := m.Buffer()
+	if uint64(length) > uint64(len(buf)) {
+		return ts, errs.New("record too large: %d > %d", length, len(buf))
+	}
+	if _, err := io.ReadFull(c.br, buf[:length]); err != nil {
+		return ts, errs.Wrap(noEOF(err))
+	}
+
+	m.Data = buf[:length]
+	m.SetSource(parseSource(string(source)))
+	return ts, nil
+}
+
+// Replay feeds the Messages in a capture back into a Handler.
+type Replay struct {
+	// Handler is called with each Message in the capture, one at a time and
+	// in the order they were recorded.
+	Handler Handler
+
+	// Speed controls how fast the capture is replayed relative to how it was
+	// recorded. One keeps the original timing, two is twice as fast, and so
+	// on. Zero replays as fast as possible.
+	Speed float64
+}
+
+// Run replays the capture until it is finished or the context is cancelled.
+func (r Replay) Run(ctx context.Context, capture io.Reader) (err error) {
+	cr, err := NewCaptureReader(capture)
+	if err != nil {
+		return err
+	}
+
+	var first time.Time
+	start := time.Now()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		m := getMessage()
+		ts, err := cr.Next(m)
+		if err != nil {
+			m.Release()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if r.Speed > 0 {
+			if first.IsZero() {
+				first = ts
+			}
+			offset := time.Duration(float64(ts.Sub(first)) / r.Speed)
+			if err := sleepUntil(ctx, start.Add(offset)); err != nil {
+				m.Release()
+				return err
+			}
+		}
+
+		r.Handler.Handle(ctx, m)
+		m.Release()
+	}
+}
+
+// sleepUntil waits until the deadline or until the context is done.
+func sleepUntil(ctx context.Context, deadline time.Time) error {
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseSource converts a source recorded in a capture back into an address.
+func parseSource(source string) net.Addr {
+	idx := strings.Index(source, "://")
+	if idx < 0 {
+		return nil
+	}
+	network, address := source[:idx], source[idx+3:]
+
+	switch network {
+	case "udp", "udp4", "udp6":
+		addr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return nil
+		}
+		return addr
+	case "tcp", "tcp4", "tcp6":
+		addr, err := net.ResolveTCPAddr(network, address)
+		if err != nil {
+			return nil
+		}
+		return addr
+	case "unix", "unixgram", "unixpacket":
+		return &net.UnixAddr{Name: address, Net: network}
+	default:
+		return nil
+	}
+}
+
+// noEOF converts an io.EOF in the middle of a record into an unexpected one.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func appendUint64(buf []byte, x uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], x)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint32(buf []byte, x uint32) []byte {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], x)
+	return append(buf, tmp[:]...)
+}
@@ -0,0 +1,107 @@
+package admission
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zeebo/assert"
+)
+
+// sourceHandler records the source of every Message it handles.
+type sourceHandler struct {
+	mu      sync.Mutex
+	data    []string
+	sources []string
+}
+
+func (s *sourceHandler) Handle(ctx context.Context, m *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data = append(s.data, string(m.Data))
+	if source := m.Source(); source != nil {
+		s.sources = append(s.sources, source.Network()+" "+source.String())
+	} else {
+		s.sources = append(s.sources, "")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+
+	var capture bytes.Buffer
+	next := new(sourceHandler)
+	rec, err := NewRecorder(&capture, next)
+	assert.NoError(t, err)
+
+	sources := []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234},
+		&net.UDPAddr{IP: net.ParseIP("::1"), Port: 5678},
+		&net.UnixAddr{Name: "/tmp/sock", Net: "unixgram"},
+		nil,
+	}
+	for i, source := range sources {
+		m := new(Message)
+		m.Data = append(m.Buffer()[:0], byte('a'+i))
+		m.SetSource(source)
+		rec.Handle(ctx, m)
+	}
+	assert.NoError(t, rec.Flush())
+	assert.That(t, IsCapture(capture.Bytes()))
+
+	replayed := new(sourceHandler)
+	assert.NoError(t, Replay{Handler: replayed}.Run(ctx, bytes.NewReader(capture.Bytes())))
+
+	assert.DeepEqual(t, replayed.data, next.data)
+	assert.DeepEqual(t, replayed.sources, next.sources)
+	assert.DeepEqual(t, replayed.sources, []string{
+		"udp 10.0.0.1:1234",
+		"udp [::1]:5678",
+		"unixgram /tmp/sock",
+		"",
+	})
+
+	// a truncated capture is an error.
+	truncated := capture.Bytes()[:capture.Len()-1]
+	assert.Error(t, Replay{Handler: new(sourceHandler)}.Run(ctx, bytes.NewReader(truncated)))
+
+	// so is something that isn't a capture.
+	assert.Error(t, Replay{Handler: new(sourceHandler)}.Run(ctx, bytes.NewReader([]byte("nope nope"))))
+}
+
+func TestReplay_Speed(t *testing.T) {
+	ctx := context.Background()
+
+	var capture bytes.Buffer
+	rec, err := NewRecorder(&capture, nil)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		m := new(Message)
+		m.Data = []byte("x")
+		rec.record(now.Add(time.Duration(i)*100*time.Millisecond), m)
+	}
+	assert.NoError(t, rec.Flush())
+
+	timed := func(speed float64) time.Duration {
+		start := time.Now()
+		err := Replay{Handler: new(sourceHandler), Speed: speed}.Run(ctx, bytes.NewReader(capture.Bytes()))
+		assert.NoError(t, err)
+		return time.Since(start)
+	}
+
+	assert.That(t, timed(1) >= 200*time.Millisecond)
+	assert.That(t, timed(4) >= 50*time.Millisecond)
+	assert.That(t, timed(0) < 50*time.Millisecond)
+
+	// cancelling the context stops the replay.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = Replay{Handler: new(sourceHandler), Speed: 1}.Run(ctx, bytes.NewReader(capture.Bytes()))
+	assert.Error(t, err)
+}
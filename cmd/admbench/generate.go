@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/errs"
+)
+
+// timestampHeader is the header carrying the time a packet was generated, in
+// nanoseconds since the unix epoch, so the sink can measure latency.
+const timestampHeader = "bench-ts"
+
+// series is a single generated series and its current value.
+type series struct {
+	key    string
+	labels []admproto.Label
+	value  float64
+}
+
+// generator builds packets for a single simulated sender, cycling through its
+// series and filling each packet up to the packet size.
+type generator struct {
+	application string
+	instance_id []byte
+	packetSize  int
+
+	w      admproto.Writer
+	rng    *rand.Rand
+	series []series
+	next   int
+}
+
+// newGenerator returns a generator for the sender with the given number of
+// series, each carrying the given number of labels.
+func newGenerator(sender, numSeries, numLabels, packetSize int, opts admproto.Options) *generator {
+	g := &generator{
+		application: "admbench",
+		instance_id: []byte(fmt.Sprintf("sender-%d", sender)),
+		packetSize:  packetSize,
+
+		w:   admproto.NewWriterWith(opts),
+		rng: rand.New(rand.NewSource(int64(sender))),
+	}
+
+	// series look like the output of a monitoring library: a handful of
+	// scopes, each with some functions and a few fields per function.
+	fields := []string{"count", "sum", "min", "max", "recent"}
+	for i := 0; i < numSeries; i++ {
+		s := series{
+			key: fmt.Sprintf("bench.scope%d.func%d.%s",
+				i%17, i/len(fields), fields[i%len(fields)]),
+			value: g.rng.Float64() * 1000,
+		}
+		for j := 0; j < numLabels; j++ {
+			s.labels = append(s.labels, admproto.Label{
+				Key:   "label" + strconv.Itoa(j),
+				Value: "value" + strconv.Itoa((i>>uint(j))%8),
+			})
+		}
+		g.series = append(g.series, s)
+	}
+
+	return g
+}
+
+// packet appends a packet to buf without the checksum, returning it and the
+// number of points in it.
+func (g *generator) packet(buf []byte, now time.Time) (out []byte, points int, err error) {
+	g.w.Reset()
+
+	buf, err = g.w.Begin(buf, g.application, g.instance_id, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	buf, err = g.w.AppendHeader(buf,
+		[]byte(timestampHeader), []byte(strconv.FormatInt(now.UnixNano(), 10)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		s := &g.series[g.next]
+		// keep the values in a range every float encoding can represent.
+		if s.value += g.rng.NormFloat64(); s.value < 0 || s.value > 1000 {
+			s.value = g.rng.Float64() * 1000
+		}
+
+		before := buf
+		buf, err = g.w.AppendLabeled(buf, s.key, s.labels, s.value)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// leave room for the checksum.
+		if len(buf)+4 > g.packetSize {
+			if points == 0 {
+				return nil, 0, errs.New("packet size %d too small for a point", g.packetSize)
+			}
+			return before, points, nil
+		}
+
+		points++
+		g.next = (g.next + 1) % len(g.series)
+	}
+}
+
+// parseEncoding returns the float encoding with the name.
+func parseEncoding(name string) (admproto.FloatEncoding, error) {
+	switch name {
+	case "float16":
+		return admproto.Float16Encoding, nil
+	case "float32":
+		return admproto.Float32Encoding, nil
+	case "float64":
+		return admproto.Float64Encoding, nil
+	case "bfloat16":
+		return admproto.BFloat16Encoding, nil
+	case "fixed":
+		return admproto.FixedEncoding, nil
+	default:
+		return 0, errs.New("unknown float encoding: %q", name)
+	}
+}
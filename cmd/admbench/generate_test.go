@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zeebo/admission/v3"
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/internal/packet"
+	"github.com/zeebo/assert"
+)
+
+func TestGenerator(t *testing.T) {
+	for _, name := range []string{"float16", "float32", "float64", "bfloat16", "fixed"} {
+		encoding, err := parseEncoding(name)
+		assert.NoError(t, err)
+
+		opts := admproto.Options{FloatEncoding: encoding, FixedExponent: -2, Labels: true}
+		g := newGenerator(1, 50, 3, 512, opts)
+
+		seen := make(map[string]bool)
+		for i := 0; i < 20; i++ {
+			buf, points, err := g.packet(nil, time.Now())
+			assert.NoError(t, err)
+			datagram := admproto.AddChecksum(buf)
+			assert.That(t, len(datagram) <= 512)
+
+			p, err := packet.Decode(datagram)
+			assert.NoError(t, err)
+			assert.Equal(t, p.Application, "admbench")
+			assert.Equal(t, string(p.InstanceID), "sender-1")
+			assert.Equal(t, len(p.Points), points)
+			for _, point := range p.Points {
+				assert.Equal(t, len(point.Labels), 3)
+				seen[point.Key] = true
+			}
+		}
+
+		// every series was cycled through.
+		assert.That(t, len(seen) > 1)
+	}
+
+	_, _, err := newGenerator(0, 1, 0, 10, admproto.Options{}).packet(nil, time.Now())
+	assert.Error(t, err)
+}
+
+func TestSink(t *testing.T) {
+	st := newStats()
+	g := newGenerator(0, 10, 1, 512, admproto.Options{Labels: true})
+	buf, points, err := g.packet(nil, time.Now().Add(-time.Millisecond))
+	assert.NoError(t, err)
+
+	s := sink{stats: st}
+	s.Handle(context.Background(), &admission.Message{Data: admproto.AddChecksum(buf)})
+	s.Handle(context.Background(), &admission.Message{Data: []byte("garbage")})
+
+	snap := st.snapshot(false)
+	assert.Equal(t, snap.recvPackets, int64(1))
+	assert.Equal(t, snap.recvPoints, int64(points))
+	assert.Equal(t, snap.recvErrors, int64(1))
+	assert.Equal(t, snap.latency.Count(), uint64(1))
+	assert.That(t, snap.latency.Quantile(0.5) > 0.0005)
+
+	// interval snapshots reset the distributions but totals keep them.
+	interval, total := st.snapshot(false), st.snapshot(true)
+	assert.Equal(t, interval.latency.Count(), uint64(0))
+	assert.Equal(t, total.latency.Count(), uint64(1))
+}
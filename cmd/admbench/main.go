@@ -0,0 +1,302 @@
+// admbench generates admproto traffic to size collectors, and can run a local
+// Dispatcher sink to measure how much of it is handled.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/zeebo/admission/v3"
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/internal/packet"
+	"github.com/zeebo/errs"
+)
+
+var (
+	targetFlag = flag.String("target", "",
+		"address to send to: a udp host:port or unixgram://path (defaults to the sink)")
+	sinkFlag = flag.Bool("sink", false,
+		"run a Dispatcher sink and report what it receives")
+	listenFlag = flag.String("listen", "127.0.0.1:0",
+		"address for the sink to listen on: a udp host:port or unixgram://path")
+	inFlightFlag = flag.Int("in-flight", 0,
+		"concurrent handler calls allowed by the sink (zero for the default)")
+
+	sendersFlag = flag.Int("senders", 4,
+		"number of simulated senders, each with its own instance id and socket")
+	seriesFlag = flag.Int("series", 1000,
+		"number of series per sender")
+	labelsFlag = flag.Int("labels", 2,
+		"number of labels per series")
+	encodingFlag = flag.String("encoding", "float16",
+		"float encoding: float16, float32, float64, bfloat16 or fixed")
+	exponentFlag = flag.Int("exponent", -2,
+		"power of ten for the fixed encoding")
+	packetSizeFlag = flag.Int("packet-size", 1024,
+		"size of generated packets")
+	rateFlag = flag.Float64("rate", 0,
+		"total packets per second to send across all senders (zero is unlimited)")
+
+	durationFlag = flag.Duration("duration", 10*time.Second,
+		"how long to send for")
+	reportFlag = flag.Duration("report", time.Second,
+		"how often to print stats")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "admbench:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	encoding, err := parseEncoding(*encodingFlag)
+	if err != nil {
+		return err
+	}
+	if *sendersFlag <= 0 || *seriesFlag <= 0 {
+		return errs.New("-senders and -series must be positive")
+	}
+
+	if *packetSizeFlag <= 0 {
+		return errs.New("-packet-size must be positive")
+	}
+
+	// the sink drops any packet that does not fit in a Message, which would
+	// be reported as a drop rate rather than as a mistake.
+	if max := len(new(admission.Message).Buffer()); *sinkFlag && *packetSizeFlag > max {
+		return errs.New("-packet-size must be at most %d with -sink", max)
+	}
+	opts := admproto.Options{
+		FloatEncoding: encoding,
+		FixedExponent: int8(*exponentFlag),
+		Labels:        true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	st := newStats()
+
+	target := *targetFlag
+	var sinkDone chan error
+	var stopSink func()
+	if *sinkFlag {
+		var address string
+		address, stopSink, sinkDone, err = startSink(st, *listenFlag)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			target = address
+		}
+	}
+	if target == "" {
+		return errs.New("one of -target or -sink is required")
+	}
+
+	sendCtx, sendCancel := context.WithTimeout(ctx, *durationFlag)
+	defer sendCancel()
+
+	var wg sync.WaitGroup
+	errch := make(chan error, *sendersFlag)
+	for i := 0; i < *sendersFlag; i++ {
+		g := newGenerator(i, *seriesFlag, *labelsFlag, *packetSizeFlag, opts)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errch <- send(sendCtx, st, g, target, *rateFlag/float64(*sendersFlag))
+		}()
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(*reportFlag)
+	defer ticker.Stop()
+
+	last, lastTime := st.snapshot(false), start
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			snap := st.snapshot(false)
+			report(snap, last, now.Sub(lastTime), *sinkFlag)
+			last, lastTime = snap, now
+		case <-done:
+			running = false
+		}
+	}
+	elapsed := time.Since(start)
+
+	// give the sink a moment to handle anything still in flight.
+	if stopSink != nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	fmt.Println("--- total ---")
+	total := st.snapshot(true)
+	report(total, snapshot{}, elapsed, *sinkFlag)
+
+	if stopSink != nil {
+		stopSink()
+		if err := <-sinkDone; err != nil {
+			return err
+		}
+	}
+
+	close(errch)
+	for err := range errch {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send writes packets from the generator to the target until the context is
+// done, pacing them to the rate in packets per second if it is positive.
+func send(ctx context.Context, st *stats, g *generator, target string, rate float64) error {
+	conn, err := packet.Dial(target)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	var buf []byte
+	next := time.Now()
+	for ctx.Err() == nil {
+		if interval > 0 {
+			if wait := time.Until(next); wait > 0 {
+				time.Sleep(wait)
+			}
+			next = next.Add(interval)
+		}
+
+		var points int
+		buf, points, err = g.packet(buf[:0], time.Now())
+		if err != nil {
+			return err
+		}
+		buf = admproto.AddChecksum(buf)
+
+		if _, err := conn.Write(buf); err != nil {
+			atomic.AddInt64(&st.sendErrors, 1)
+			continue
+		}
+		atomic.AddInt64(&st.sentPackets, 1)
+		atomic.AddInt64(&st.sentPoints, int64(points))
+		atomic.AddInt64(&st.sentBytes, int64(len(buf)))
+	}
+	return nil
+}
+
+// startSink starts a Dispatcher on the address that records into the stats.
+// It returns the address to send to, a function to stop it, and a channel
+// with the result of running it.
+func startSink(st *stats, address string) (target string, stop func(), done chan error, err error) {
+	pc, rc, err := packet.Listen(address)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	target = address
+	if !strings.HasPrefix(address, packet.UnixgramScheme) {
+		target = pc.LocalAddr().String()
+	}
+
+	d := admission.Dispatcher{
+		Handler:  sink{stats: st},
+		Source:   admission.RawConnSource{Conn: rc},
+		InFlight: *inFlightFlag,
+	}
+	d.Hooks.DroppedMessage = func(ctx context.Context) {
+		atomic.AddInt64(&st.dropped, 1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done = make(chan error, 1)
+	go func() {
+		err := d.Run(ctx)
+		if ctx.Err() != nil {
+			err = nil
+		}
+		done <- err
+	}()
+
+	stop = func() {
+		cancel()
+		_ = pc.Close()
+	}
+	return target, stop, done, nil
+}
+
+// report prints the difference between the snapshots as rates over the
+// duration.
+func report(snap, last snapshot, d time.Duration, sink bool) {
+	secs := d.Seconds()
+	rate := func(now, then int64) float64 { return float64(now-then) / secs }
+
+	fmt.Printf("sent %.0f pkt/s %.0f pts/s %.2f MB/s errors %d",
+		rate(snap.sentPackets, last.sentPackets),
+		rate(snap.sentPoints, last.sentPoints),
+		rate(snap.sentBytes, last.sentBytes)/1e6,
+		snap.sendErrors-last.sendErrors)
+
+	if sink {
+		recv := snap.recvPackets - last.recvPackets
+		dropped := snap.dropped - last.dropped
+		sent := snap.sentPackets - last.sentPackets
+
+		var dropRate, lossRate float64
+		if recv+dropped > 0 {
+			dropRate = 100 * float64(dropped) / float64(recv+dropped)
+		}
+		if sent > 0 {
+			lossRate = 100 * float64(sent-recv-dropped) / float64(sent)
+		}
+
+		fmt.Printf(" | recv %.0f pkt/s %.0f pts/s dropped %d (%.2f%%) lost %.2f%% invalid %d",
+			rate(snap.recvPackets, last.recvPackets),
+			rate(snap.recvPoints, last.recvPoints),
+			dropped, dropRate, lossRate,
+			snap.recvErrors-last.recvErrors)
+
+		fmt.Printf(" | latency p50 %v p99 %v | handler p50 %v p99 %v",
+			seconds(snap.latency.Quantile(0.5)), seconds(snap.latency.Quantile(0.99)),
+			seconds(snap.handler.Quantile(0.5)), seconds(snap.handler.Quantile(0.99)))
+	}
+
+	fmt.Println()
+}
+
+// seconds converts a number of seconds into a rounded duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeebo/admission/v3"
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/internal/packet"
+)
+
+// stats are the counters shared by the senders and the sink.
+type stats struct {
+	sentPackets int64
+	sentPoints  int64
+	sentBytes   int64
+	sendErrors  int64
+
+	recvPackets int64
+	recvPoints  int64
+	recvErrors  int64
+	dropped     int64
+
+	// the distributions are split into shards so that concurrent handlers
+	// do not contend on one lock, and are merged by snapshots.
+	next   uint32
+	shards []*statShard
+}
+
+// statShard holds some of the latency distributions. latency and handler are
+// reset by every interval snapshot, and the total distributions never are.
+type statShard struct {
+	mu           sync.Mutex
+	latency      *admproto.Distribution
+	handler      *admproto.Distribution
+	totalLatency *admproto.Distribution
+	totalHandler *admproto.Distribution
+}
+
+// newStats returns stats with empty latency distributions.
+func newStats() *stats {
+	shards := make([]*statShard, 4*runtime.GOMAXPROCS(0))
+	for i := range shards {
+		shards[i] = &statShard{
+			latency:      admproto.NewDistribution(admproto.DefaultDistributionScale),
+			handler:      admproto.NewDistribution(admproto.DefaultDistributionScale),
+			totalLatency: admproto.NewDistribution(admproto.DefaultDistributionScale),
+			totalHandler: admproto.NewDistribution(admproto.DefaultDistributionScale),
+		}
+	}
+	return &stats{shards: shards}
+}
+
+// shard returns the next shard to record into.
+func (s *stats) shard() *statShard {
+	return s.shards[atomic.AddUint32(&s.next, 1)%uint32(len(s.shards))]
+}
+
+// snapshot is a copy of the stats at a point in time.
+type snapshot struct {
+	sentPackets, sentPoints, sentBytes, sendErrors int64
+	recvPackets, recvPoints, recvErrors, dropped   int64
+
+	latency, handler admproto.Distribution
+}
+
+// snapshot returns a copy of the stats. The latency distributions are the
+// ones since the last interval snapshot, or since the start if total is true.
+func (s *stats) snapshot(total bool) (snap snapshot) {
+	snap.sentPackets = atomic.LoadInt64(&s.sentPackets)
+	snap.sentPoints = atomic.LoadInt64(&s.sentPoints)
+	snap.sentBytes = atomic.LoadInt64(&s.sentBytes)
+	snap.sendErrors = atomic.LoadInt64(&s.sendErrors)
+	snap.recvPackets = atomic.LoadInt64(&s.recvPackets)
+	snap.recvPoints = atomic.LoadInt64(&s.recvPoints)
+	snap.recvErrors = atomic.LoadInt64(&s.recvErrors)
+	snap.dropped = atomic.LoadInt64(&s.dropped)
+
+	snap.latency.Scale = admproto.DefaultDistributionScale
+	snap.handler.Scale = admproto.DefaultDistributionScale
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+
+		latency, handler := shard.latency, shard.handler
+		if total {
+			latency, handler = shard.totalLatency, shard.totalHandler
+		}
+		snap.latency.Merge(latency)
+		snap.handler.Merge(handler)
+
+		if !total {
+			shard.latency.Reset()
+			shard.handler.Reset()
+		}
+
+		shard.mu.Unlock()
+	}
+	return snap
+}
+
+// sink is an admission.Handler that decodes every packet and records how long
+// it took to arrive and to decode.
+type sink struct {
+	stats *stats
+}
+
+// Handle implements admission.Handler.
+func (s sink) Handle(ctx context.Context, m *admission.Message) {
+	start := time.Now()
+
+	p, err := packet.Decode(m.Data)
+	if err != nil {
+		atomic.AddInt64(&s.stats.recvErrors, 1)
+		return
+	}
+
+	var latency time.Duration
+	var hasLatency bool
+	for _, header := range p.Headers {
+		if header.Key != timestampHeader {
+			continue
+		}
+		if ts, err := strconv.ParseInt(header.Value, 10, 64); err == nil {
+			latency, hasLatency = start.Sub(time.Unix(0, ts)), true
+		}
+	}
+
+	atomic.AddInt64(&s.stats.recvPackets, 1)
+	atomic.AddInt64(&s.stats.recvPoints, int64(len(p.Points)))
+	elapsed := time.Since(start)
+
+	shard := s.stats.shard()
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if hasLatency {
+		shard.latency.Observe(latency.Seconds())
+		shard.totalLatency.Observe(latency.Seconds())
+	}
+	shard.handler.Observe(elapsed.Seconds())
+	shard.totalHandler.Observe(elapsed.Seconds())
+}
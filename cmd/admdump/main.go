@@ -0,0 +1,189 @@
+// admdump prints the admproto packets arriving on a socket or stored in a
+// capture file.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/zeebo/admission/v3"
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/internal/packet"
+	"github.com/zeebo/errs"
+)
+
+var (
+	listenFlag = flag.String("listen", "",
+		"address to listen on: a udp host:port or unixgram://path")
+	fileFlag = flag.String("file", "",
+		"pcap or raw capture file to read instead of listening")
+	formatFlag = flag.String("format", "text",
+		"output format: text, json or line")
+	appFlag = flag.String("app", "",
+		"only print packets from this application")
+	prefixFlag = flag.String("prefix", "",
+		"only print points with keys starting with this prefix")
+	errorsFlag = flag.Bool("errors", false,
+		"print packets that fail to decode")
+	recordFlag = flag.String("record", "",
+		"also write received packets to this capture file when listening")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "admdump:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	pr, err := newPrinter(os.Stdout, *formatFlag)
+	if err != nil {
+		return err
+	}
+	pr.app = *appFlag
+	pr.prefix = *prefixFlag
+	pr.errors = *errorsFlag
+
+	switch {
+	case *fileFlag != "" && *listenFlag != "":
+		return errs.New("only one of -listen and -file may be given")
+	case *fileFlag != "":
+		return readFile(pr, *fileFlag)
+	case *listenFlag != "":
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt)
+		go func() {
+			<-sigs
+			cancel()
+		}()
+
+		return listen(ctx, pr, *listenFlag, *recordFlag)
+	default:
+		return errs.New("one of -listen or -file is required")
+	}
+}
+
+// listen prints every packet that arrives on the address until the context
+// is done, recording them to the capture file if one is given.
+func listen(ctx context.Context, pr *printer, address, record string) (err error) {
+	var h admission.Handler = pr
+	if record != "" {
+		fh, createErr := os.Create(record)
+		if createErr != nil {
+			return errs.Wrap(createErr)
+		}
+		defer func() { err = errs.Combine(err, fh.Close()) }()
+
+		rec, recErr := admission.NewRecorder(fh, pr)
+		if recErr != nil {
+			return recErr
+		}
+		defer func() { err = errs.Combine(err, rec.Flush()) }()
+		h = rec
+	}
+
+	pc, rc, err := packet.Listen(address)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = pc.Close()
+	}()
+
+	err = admission.Dispatcher{
+		Handler: h,
+		Source:  admission.RawConnSource{Conn: rc},
+	}.Run(ctx)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// readFile prints every packet in the capture, pcap or raw file. A raw file is
+// a sequence of length prefixed frames as written by admproto.AppendFrame.
+func readFile(pr *printer, path string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer func() { _ = fh.Close() }()
+
+	br := bufio.NewReader(fh)
+	magic, _ := br.Peek(8)
+
+	if admission.IsCapture(magic) {
+		cr, err := admission.NewCaptureReader(br)
+		if err != nil {
+			return err
+		}
+		var m admission.Message
+		for {
+			ts, err := cr.Next(&m)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			pr.print(ts, m.Source(), m.Data)
+		}
+	}
+
+	if isPcap(magic) {
+		p, err := newPcapReader(br)
+		if err != nil {
+			return err
+		}
+		for {
+			ts, source, _, payload, err := p.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			pr.print(ts, source, payload)
+		}
+	}
+
+	buf := make([]byte, 0, admproto.MaxFrameSize)
+	for {
+		datagram, err := admproto.ReadFrame(br, buf[:0])
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		pr.print(time.Time{}, nil, datagram)
+	}
+}
+
+// formatInstance returns the instance id as a string if it is printable, and
+// as hex otherwise.
+func formatInstance(instance_id []byte) string {
+	if !utf8.Valid(instance_id) {
+		return hex.EncodeToString(instance_id)
+	}
+	for _, r := range string(instance_id) {
+		if !unicode.IsPrint(r) {
+			return hex.EncodeToString(instance_id)
+		}
+	}
+	return string(instance_id)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zeebo/admission/v3"
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/assert"
+)
+
+// testDatagram returns a checksummed packet with a couple of points.
+func testDatagram(t *testing.T) []byte {
+	t.Helper()
+
+	w := admproto.NewWriterWith(admproto.Options{Labels: true})
+	buf, err := w.Begin(nil, "app", []byte("inst"), 1)
+	assert.NoError(t, err)
+	buf, err = w.AppendHeader(buf, []byte("k"), []byte("v"))
+	assert.NoError(t, err)
+	buf, err = w.AppendLabeled(buf, "foo.count", []admproto.Label{{Key: "b", Value: "2"}, {Key: "a", Value: "1"}}, 1)
+	assert.NoError(t, err)
+	buf, err = w.Append(buf, "bar.count", 2)
+	assert.NoError(t, err)
+	return admproto.AddChecksum(buf)
+}
+
+// testPcap wraps the payload in a little endian pcap file with a single
+// ethernet/ipv4/udp record.
+func testPcap(payload []byte) []byte {
+	var out bytes.Buffer
+	le := binary.LittleEndian
+
+	var global [24]byte
+	le.PutUint32(global[0:], 0xa1b2c3d4)
+	le.PutUint16(global[4:], 2)
+	le.PutUint16(global[6:], 4)
+	le.PutUint32(global[16:], 65535)
+	le.PutUint32(global[20:], linkEthernet)
+	out.Write(global[:])
+
+	frame := make([]byte, 14+20+8+len(payload))
+	binary.BigEndian.PutUint16(frame[12:], 0x0800)
+	ip := frame[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+8+len(payload)))
+	ip[9] = 17
+	copy(ip[12:], []byte{10, 0, 0, 1})
+	copy(ip[16:], []byte{10, 0, 0, 2})
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp[0:], 1234)
+	binary.BigEndian.PutUint16(udp[2:], 5678)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	copy(udp[8:], payload)
+
+	var record [16]byte
+	le.PutUint32(record[0:], 1)
+	le.PutUint32(record[8:], uint32(len(frame)))
+	le.PutUint32(record[12:], uint32(len(frame)))
+	out.Write(record[:])
+	out.Write(frame)
+
+	return out.Bytes()
+}
+
+func TestReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admdump")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	datagram := testDatagram(t)
+	raw, err := admproto.AppendFrame(nil, datagram)
+	assert.NoError(t, err)
+
+	var capture bytes.Buffer
+	rec, err := admission.NewRecorder(&capture, nil)
+	assert.NoError(t, err)
+	rec.Handle(context.Background(), &admission.Message{Data: datagram})
+	assert.NoError(t, rec.Flush())
+
+	files := map[string][]byte{
+		"capture.pcap": testPcap(datagram),
+		"capture.raw":  raw,
+		"capture.adm":  capture.Bytes(),
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+
+		var out bytes.Buffer
+		pr, err := newPrinter(&out, "line")
+		assert.NoError(t, err)
+		assert.NoError(t, readFile(pr, path))
+		assert.Equal(t, out.String(), ""+
+			"app inst foo.count a=1 b=2 1\n"+
+			"app inst bar.count 2\n")
+	}
+}
+
+func TestPrinterFilters(t *testing.T) {
+	datagram := testDatagram(t)
+
+	var out bytes.Buffer
+	pr, err := newPrinter(&out, "json")
+	assert.NoError(t, err)
+
+	pr.app = "other"
+	pr.print(time.Time{}, nil, datagram)
+	assert.Equal(t, out.String(), "")
+
+	pr.app, pr.prefix = "app", "bar."
+	pr.print(time.Time{}, nil, datagram)
+	assert.Equal(t, out.String(), `{"application":"app","instance_id":"inst",`+
+		`"headers":{"k":"v"},"points":[{"key":"bar.count","value":2}]}`+"\n")
+}
+
+func TestPrinterSource(t *testing.T) {
+	var out bytes.Buffer
+	pr, err := newPrinter(&out, "text")
+	assert.NoError(t, err)
+
+	m := &admission.Message{Data: testDatagram(t)}
+	m.SetSource(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234})
+	pr.Handle(context.Background(), m)
+	assert.That(t, strings.Contains(out.String(), " 10.0.0.1:1234"))
+}
+
+func TestPcapRecordTooLarge(t *testing.T) {
+	// a record claiming to be larger than the snapshot length is an error
+	// instead of an allocation of whatever size it claims.
+	data := testPcap(testDatagram(t))
+	binary.LittleEndian.PutUint32(data[24+8:], 0xffffffff)
+
+	p, err := newPcapReader(bytes.NewReader(data))
+	assert.NoError(t, err)
+	_, _, _, _, err = p.Next()
+	assert.Error(t, err)
+}
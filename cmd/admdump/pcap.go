@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/zeebo/errs"
+)
+
+// pcap link types that can be decoded.
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+)
+
+// pcapMaxRecord is the largest record that will be read from a capture, even
+// if the capture claims records can be larger.
+const pcapMaxRecord = 256 << 10
+
+// pcapReader reads UDP payloads out of a pcap capture file.
+type pcapReader struct {
+	r       io.Reader
+	order   binary.ByteOrder
+	nanos   bool
+	link    uint32
+	snaplen uint32
+}
+
+// isPcap returns true if the start of a file is a pcap global header.
+func isPcap(magic []byte) bool {
+	if len(magic) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(magic) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+		return true
+	default:
+		return false
+	}
+}
+
+// newPcapReader reads the pcap global header from r.
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errs.Wrap(err)
+	}
+
+	p := &pcapReader{r: r}
+	switch binary.LittleEndian.Uint32(hdr[:4]) {
+	case 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		p.order, p.nanos = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		p.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		p.order, p.nanos = binary.BigEndian, true
+	default:
+		return nil, errs.New("not a pcap file")
+	}
+	p.link = p.order.Uint32(hdr[20:24])
+
+	// records are never longer than the snapshot length, so a longer one
+	// means the capture is corrupt.
+	p.snaplen = p.order.Uint32(hdr[16:20])
+	if p.snaplen == 0 || p.snaplen > pcapMaxRecord {
+		p.snaplen = pcapMaxRecord
+	}
+
+	switch p.link {
+	case linkNull, linkEthernet, linkRaw, linkLinuxSLL:
+	default:
+		return nil, errs.New("unsupported pcap link type: %d", p.link)
+	}
+
+	return p, nil
+}
+
+// Next returns the next UDP payload in the capture, along with when it was
+// captured and who sent it. It skips any records that are not UDP.
+func (p *pcapReader) Next() (ts time.Time, source, dest *net.UDPAddr, payload []byte, err error) {
+	for {
+		var hdr [16]byte
+		if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return ts, nil, nil, nil, err
+			}
+			return ts, nil, nil, nil, errs.Wrap(err)
+		}
+
+		sec := int64(p.order.Uint32(hdr[0:4]))
+		frac := int64(p.order.Uint32(hdr[4:8]))
+		if !p.nanos {
+			frac *= 1000
+		}
+		ts = time.Unix(sec, frac)
+
+		length := p.order.Uint32(hdr[8:12])
+		if length > p.snaplen {
+			return ts, nil, nil, nil, errs.New("pcap record too large: %d", length)
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(p.r, data); err != nil {
+			return ts, nil, nil, nil, errs.Wrap(err)
+		}
+
+		source, dest, payload, ok := decodeLink(p.link, data)
+		if ok {
+			return ts, source, dest, payload, nil
+		}
+	}
+}
+
+// decodeLink returns the UDP payload in the link layer frame.
+func decodeLink(link uint32, data []byte) (source, dest *net.UDPAddr, payload []byte, ok bool) {
+	switch link {
+	case linkNull:
+		if len(data) < 4 {
+			return nil, nil, nil, false
+		}
+		return decodeIP(data[4:])
+
+	case linkEthernet:
+		if len(data) < 14 {
+			return nil, nil, nil, false
+		}
+		ethertype, data := binary.BigEndian.Uint16(data[12:14]), data[14:]
+		// skip any vlan tags
+		for ethertype == 0x8100 && len(data) >= 4 {
+			ethertype, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+		return decodeIP(data)
+
+	case linkRaw:
+		return decodeIP(data)
+
+	case linkLinuxSLL:
+		if len(data) < 16 {
+			return nil, nil, nil, false
+		}
+		return decodeIP(data[16:])
+
+	default:
+		return nil, nil, nil, false
+	}
+}
+
+// decodeIP returns the UDP payload in the IPv4 or IPv6 packet. Fragments and
+// IPv6 extension headers are not supported.
+func decodeIP(data []byte) (source, dest *net.UDPAddr, payload []byte, ok bool) {
+	if len(data) < 1 {
+		return nil, nil, nil, false
+	}
+
+	var src, dst net.IP
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil, nil, nil, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		fragmented := binary.BigEndian.Uint16(data[6:8])&0x3fff != 0
+		if data[9] != 17 || fragmented || ihl < 20 || len(data) < ihl {
+			return nil, nil, nil, false
+		}
+		src, dst = net.IP(data[12:16]), net.IP(data[16:20])
+		data = data[ihl:]
+
+	case 6:
+		if len(data) < 40 || data[6] != 17 {
+			return nil, nil, nil, false
+		}
+		src, dst = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[40:]
+
+	default:
+		return nil, nil, nil, false
+	}
+
+	if len(data) < 8 {
+		return nil, nil, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(data[4:6]))
+	if length < 8 || length > len(data) {
+		return nil, nil, nil, false
+	}
+
+	source = &net.UDPAddr{IP: src, Port: int(binary.BigEndian.Uint16(data[0:2]))}
+	dest = &net.UDPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(data[2:4]))}
+	return source, dest, data[8:length], true
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeebo/admission/v3"
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/internal/packet"
+	"github.com/zeebo/errs"
+)
+
+// printer decodes packets and writes the ones that pass the filters. It is
+// safe for concurrent use.
+type printer struct {
+	format string
+	app    string
+	prefix string
+	errors bool
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newPrinter returns a printer writing in the format to w.
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	switch format {
+	case "text", "json", "line":
+	default:
+		return nil, errs.New("unknown format: %q", format)
+	}
+	return &printer{format: format, w: w}, nil
+}
+
+// Handle implements admission.Handler by printing the message.
+func (pr *printer) Handle(ctx context.Context, m *admission.Message) {
+	pr.print(time.Now(), m.Source(), m.Data)
+}
+
+// print decodes and prints the datagram. The timestamp and source are
+// included when they are known.
+func (pr *printer) print(ts time.Time, source net.Addr, datagram []byte) {
+	p, err := packet.Decode(datagram)
+	if err != nil {
+		if pr.errors {
+			pr.write(fmt.Sprintf("%s invalid packet (%d bytes): %v\n",
+				formatPrefix(ts, source), len(datagram), err))
+		}
+		return
+	}
+
+	if pr.app != "" && p.Application != pr.app {
+		return
+	}
+	if pr.prefix != "" {
+		points := p.Points[:0]
+		for _, point := range p.Points {
+			if strings.HasPrefix(point.Key, pr.prefix) {
+				points = append(points, point)
+			}
+		}
+		if len(points) == 0 {
+			return
+		}
+		p.Points = points
+	}
+
+	var sb strings.Builder
+	switch pr.format {
+	case "text":
+		formatText(&sb, ts, source, p)
+	case "json":
+		formatJSON(&sb, ts, source, p)
+	case "line":
+		formatLine(&sb, p)
+	}
+	pr.write(sb.String())
+}
+
+// write writes the output in a single call so that concurrent packets are not
+// interleaved.
+func (pr *printer) write(out string) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	_, _ = io.WriteString(pr.w, out)
+}
+
+// formatPrefix returns the timestamp and source for the start of a text line.
+func formatPrefix(ts time.Time, source net.Addr) string {
+	var parts []string
+	if !ts.IsZero() {
+		parts = append(parts, ts.Format(time.RFC3339Nano))
+	}
+	if source != nil {
+		parts = append(parts, source.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// formatText writes a multi-line human readable description of the packet.
+func formatText(sb *strings.Builder, ts time.Time, source net.Addr, p *packet.Packet) {
+	if prefix := formatPrefix(ts, source); prefix != "" {
+		sb.WriteString(prefix)
+		sb.WriteString(" ")
+	}
+	fmt.Fprintf(sb, "app=%q instance=%q", p.Application, formatInstance(p.InstanceID))
+	switch p.Frame {
+	case admproto.Keyframe:
+		fmt.Fprintf(sb, " keyframe=%d", p.Generation)
+	case admproto.DeltaFrame:
+		fmt.Fprintf(sb, " delta=%d", p.Generation)
+	}
+	fmt.Fprintf(sb, " points=%d\n", len(p.Points))
+
+	for _, header := range p.Headers {
+		fmt.Fprintf(sb, "  header %q = %q\n", header.Key, header.Value)
+	}
+
+	for _, point := range p.Points {
+		sb.WriteString("  ")
+		sb.WriteString(point.Key)
+		if len(point.Labels) > 0 {
+			sb.WriteString("{")
+			for i, label := range point.Labels {
+				if i > 0 {
+					sb.WriteString(",")
+				}
+				fmt.Fprintf(sb, "%s=%q", label.Key, label.Value)
+			}
+			sb.WriteString("}")
+		}
+
+		if dist := point.Distribution; dist != nil {
+			fmt.Fprintf(sb, " = distribution count=%d sum=%v p50=%v p99=%v\n",
+				dist.Count(), dist.Sum, dist.Quantile(0.5), dist.Quantile(0.99))
+		} else if point.Delta {
+			fmt.Fprintf(sb, " += %v\n", point.Value)
+		} else {
+			fmt.Fprintf(sb, " = %v\n", point.Value)
+		}
+	}
+}
+
+// jsonFloat is a float64 that marshals non-finite values as strings.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return []byte(strconv.Quote(strconv.FormatFloat(v, 'g', -1, 64))), nil
+	}
+	return []byte(strconv.FormatFloat(v, 'g', -1, 64)), nil
+}
+
+type jsonPacket struct {
+	Time        string            `json:"time,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	Application string            `json:"application"`
+	InstanceID  string            `json:"instance_id"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Frame       string            `json:"frame,omitempty"`
+	Generation  uint64            `json:"generation,omitempty"`
+	Points      []jsonPoint       `json:"points"`
+}
+
+type jsonPoint struct {
+	Key          string            `json:"key"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Value        *jsonFloat        `json:"value,omitempty"`
+	Delta        bool              `json:"delta,omitempty"`
+	Distribution *jsonDistribution `json:"distribution,omitempty"`
+}
+
+type jsonDistribution struct {
+	Scale    int8              `json:"scale"`
+	Count    uint64            `json:"count"`
+	Sum      jsonFloat         `json:"sum"`
+	Zero     uint64            `json:"zero"`
+	Positive []admproto.Bucket `json:"positive,omitempty"`
+	Negative []admproto.Bucket `json:"negative,omitempty"`
+}
+
+// formatJSON writes the packet as a single line JSON object.
+func formatJSON(sb *strings.Builder, ts time.Time, source net.Addr, p *packet.Packet) {
+	out := jsonPacket{
+		Application: p.Application,
+		InstanceID:  formatInstance(p.InstanceID),
+		Generation:  p.Generation,
+		Points:      make([]jsonPoint, 0, len(p.Points)),
+	}
+	if !ts.IsZero() {
+		out.Time = ts.Format(time.RFC3339Nano)
+	}
+	if source != nil {
+		out.Source = source.String()
+	}
+	switch p.Frame {
+	case admproto.Keyframe:
+		out.Frame = "keyframe"
+	case admproto.DeltaFrame:
+		out.Frame = "delta"
+	}
+	if len(p.Headers) > 0 {
+		out.Headers = make(map[string]string, len(p.Headers))
+		for _, header := range p.Headers {
+			out.Headers[header.Key] = header.Value
+		}
+	}
+
+	for _, point := range p.Points {
+		jp := jsonPoint{Key: point.Key, Delta: point.Delta}
+		if len(point.Labels) > 0 {
+			jp.Labels = make(map[string]string, len(point.Labels))
+			for _, label := range point.Labels {
+				jp.Labels[label.Key] = label.Value
+			}
+		}
+		if dist := point.Distribution; dist != nil {
+			jp.Distribution = &jsonDistribution{
+				Scale:    dist.Scale,
+				Count:    dist.Count(),
+				Sum:      jsonFloat(dist.Sum),
+				Zero:     dist.Zero,
+				Positive: dist.Positive,
+				Negative: dist.Negative,
+			}
+		} else {
+			value := jsonFloat(point.Value)
+			jp.Value = &value
+		}
+		out.Points = append(out.Points, jp)
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		fmt.Fprintf(sb, "{\"error\":%q}\n", err.Error())
+		return
+	}
+	sb.Write(data)
+	sb.WriteString("\n")
+}
+
+// formatLine writes one line per point with the application, instance id, key,
+// sorted labels and value separated by spaces.
+func formatLine(sb *strings.Builder, p *packet.Packet) {
+	instance := formatInstance(p.InstanceID)
+	for _, point := range p.Points {
+		fmt.Fprintf(sb, "%s %s %s", p.Application, instance, point.Key)
+
+		labels := append([]admproto.Label(nil), point.Labels...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Key < labels[j].Key })
+		for _, label := range labels {
+			fmt.Fprintf(sb, " %s=%s", label.Key, label.Value)
+		}
+
+		if dist := point.Distribution; dist != nil {
+			fmt.Fprintf(sb, " count=%d sum=%v\n", dist.Count(), dist.Sum)
+		} else if point.Delta {
+			fmt.Fprintf(sb, " +%v\n", point.Value)
+		} else {
+			fmt.Fprintf(sb, " %v\n", point.Value)
+		}
+	}
+}
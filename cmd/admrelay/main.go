@@ -0,0 +1,198 @@
+// admrelay receives admproto packets and forwards them to upstreams.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/zeebo/admission/v3"
+	"github.com/zeebo/admission/v3/admmonkit"
+	"github.com/zeebo/admission/v3/internal/packet"
+	"github.com/zeebo/errs"
+)
+
+// stringsFlag is a flag that can be passed multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string     { return strings.Join(*s, ",") }
+func (s *stringsFlag) Set(v string) error { *s = append(*s, v); return nil }
+
+var (
+	listenFlag = flag.String("listen", "",
+		"address to listen on: a udp host:port or unixgram://path")
+	shardFlag = flag.Bool("shard", false,
+		"send each application/instance id to one upstream instead of all of them")
+	prefixFlag = flag.String("prefix", "",
+		"only forward points with keys starting with this prefix, except in keyframe and delta packets")
+	repackFlag = flag.Bool("repack", false,
+		"combine points from small packets into larger ones")
+	packetSizeFlag = flag.Int("packet-size", 1024,
+		"largest packet to send when encoding packets, at most what a Dispatcher can read")
+	flushFlag = flag.Duration("flush", time.Second,
+		"how often to send repacked points")
+
+	upstreamFlags stringsFlag
+	headerFlags   stringsFlag
+	appFlags      stringsFlag
+)
+
+func init() {
+	flag.Var(&upstreamFlags, "upstream",
+		"address to forward to: a udp host:port, unixgram://path or tcp://host:port (repeatable)")
+	flag.Var(&headerFlags, "header",
+		"key=value header to add to every packet (repeatable)")
+	flag.Var(&appFlags, "app",
+		"only forward packets from this application (repeatable)")
+}
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "admrelay:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *listenFlag == "" {
+		return errs.New("-listen is required")
+	}
+	if len(upstreamFlags) == 0 {
+		return errs.New("at least one -upstream is required")
+	}
+
+	// upstream dispatchers drop any packet that does not fit in a Message.
+	if max := len(new(admission.Message).Buffer()); *packetSizeFlag <= 0 || *packetSizeFlag > max {
+		return errs.New("-packet-size must be between 1 and %d", max)
+	}
+
+	r := &relay{
+		shard:      *shardFlag,
+		prefix:     *prefixFlag,
+		repack:     *repackFlag,
+		packetSize: *packetSizeFlag,
+	}
+
+	for _, app := range appFlags {
+		if r.apps == nil {
+			r.apps = make(map[string]bool)
+		}
+		r.apps[app] = true
+	}
+
+	for _, header := range headerFlags {
+		idx := strings.IndexByte(header, '=')
+		if idx < 0 {
+			return errs.New("invalid header %q: expected key=value", header)
+		}
+		r.headers = append(r.headers, packet.Header{Key: header[:idx], Value: header[idx+1:]})
+	}
+
+	for _, address := range upstreamFlags {
+		upstream, err := dialUpstream(address)
+		if err != nil {
+			return errs.Wrap(err)
+		}
+		defer closeUpstream(upstream)
+		r.upstreams = append(r.upstreams, upstream)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	if r.repack {
+		// deferred after the upstreams so that it runs before they are
+		// flushed and closed.
+		defer r.flush()
+		go func() {
+			ticker := time.NewTicker(*flushFlag)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					r.flush()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	err := listen(ctx, r, *listenFlag)
+	if n := atomic.LoadInt64(&r.unfiltered); n > 0 {
+		log.Println("forwarded", n, "keyframe and delta packets without filtering by prefix")
+	}
+	return err
+}
+
+// listen passes every packet that arrives on the address to the handler until
+// the context is done.
+func listen(ctx context.Context, h admission.Handler, address string) error {
+	pc, rc, err := packet.Listen(address)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = pc.Close()
+	}()
+
+	// delta frames must reach the upstreams in the order they were sent.
+	d := admission.Dispatcher{
+		Handler:  h,
+		Source:   admission.RawConnSource{Conn: rc},
+		Ordering: admission.OrderByInstance,
+	}
+	d.Hooks.Dropped = func(ctx context.Context, reason admission.DropReason, m *admission.Message) {
+		log.Println("dropped packet:", reason)
+	}
+
+	err = d.Run(ctx)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// streamFlushTimeout is how long to wait for a stream upstream to send the
+// packets it has queued when shutting down.
+const streamFlushTimeout = 5 * time.Second
+
+// closeUpstream closes the upstream. Streams are given a little while to send
+// the packets they have queued first, because closing them drops the packets.
+func closeUpstream(upstream io.WriteCloser) {
+	if stream, ok := upstream.(*admmonkit.StreamSender); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), streamFlushTimeout)
+		if err := stream.Flush(ctx); err != nil {
+			log.Println("failed to flush upstream:", err)
+		}
+		cancel()
+	}
+	_ = upstream.Close()
+}
+
+// dialUpstream connects to the upstream address.
+func dialUpstream(address string) (io.WriteCloser, error) {
+	if strings.HasPrefix(address, "tcp://") {
+		return admmonkit.NewStreamSender(strings.TrimPrefix(address, "tcp://"), 0), nil
+	}
+	return packet.Dial(address)
+}
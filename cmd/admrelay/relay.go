@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/zeebo/admission/v3"
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/internal/packet"
+)
+
+// relay is an admission.Handler that forwards packets to upstreams. Packets
+// are forwarded unmodified unless headers are injected, points are filtered or
+// repacking is enabled, in which case they are decoded and encoded again.
+// Keyframe and delta packets only ever have their headers rewritten. It is safe
+// for concurrent use.
+type relay struct {
+	// unfiltered counts the keyframe and delta packets forwarded without
+	// their points being filtered by the prefix. It is first so that it is
+	// aligned for atomic access.
+	unfiltered int64
+
+	// upstreams are where packets are written.
+	upstreams []io.Writer
+
+	// shard causes every packet to be sent to a single upstream picked by a
+	// hash of the application and instance id, rather than to all of them.
+	shard bool
+
+	// apps, if not empty, is the set of applications that are forwarded.
+	apps map[string]bool
+
+	// prefix, if set, is required of the key of every forwarded point.
+	prefix string
+
+	// headers are added to every packet, replacing any with the same key.
+	headers []packet.Header
+
+	// repack causes points from packets with the same application, instance
+	// id and headers to be combined until flush is called.
+	repack bool
+
+	// packetSize is the largest packet that will be encoded.
+	packetSize int
+
+	mu       sync.Mutex
+	encoders map[string]*encoder
+}
+
+// Handle implements admission.Handler.
+func (r *relay) Handle(ctx context.Context, m *admission.Message) {
+	p, err := packet.Decode(m.Data)
+	if err != nil {
+		return
+	}
+	if len(r.apps) > 0 && !r.apps[p.Application] {
+		return
+	}
+
+	targets := r.targets(p)
+
+	if p.Frame != admproto.StatelessFrame {
+		r.forwardFrame(targets, p, m.Data)
+		return
+	}
+	if !r.repack && r.prefix == "" && len(r.headers) == 0 {
+		write(targets, m.Data)
+		return
+	}
+
+	if r.prefix != "" {
+		points := p.Points[:0]
+		for _, point := range p.Points {
+			if strings.HasPrefix(point.Key, r.prefix) {
+				points = append(points, point)
+			}
+		}
+		if len(points) == 0 {
+			return
+		}
+		p.Points = points
+	}
+	p.Headers = mergeHeaders(p.Headers, r.headers)
+
+	if !r.repack {
+		e := newEncoder(p, r.packetSize, targets)
+		e.add(p.Points)
+		e.flush()
+		return
+	}
+
+	key := encoderKey(p)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.encoders[key]
+	if !ok {
+		if r.encoders == nil {
+			r.encoders = make(map[string]*encoder)
+		}
+		e = newEncoder(p, r.packetSize, targets)
+		r.encoders[key] = e
+	}
+	e.add(p.Points)
+}
+
+// forwardFrame forwards a keyframe or delta packet. Their values depend on
+// state kept by the receiver for the sender, so the points are forwarded as
+// they are, and only the headers are rewritten.
+func (r *relay) forwardFrame(targets []io.Writer, p *packet.Packet, datagram []byte) {
+	if r.prefix != "" && atomic.AddInt64(&r.unfiltered, 1) == 1 {
+		log.Println("forwarding keyframe and delta packets without filtering by prefix")
+	}
+	if len(r.headers) == 0 {
+		write(targets, datagram)
+		return
+	}
+
+	// the checksum was verified when the packet was decoded.
+	buf, err := admproto.RewriteHeaders(nil, datagram[:len(datagram)-4], mergeHeaders(p.Headers, r.headers))
+	if err != nil {
+		log.Println("dropped packet because", err)
+		return
+	}
+	write(targets, admproto.AddChecksum(buf))
+}
+
+// flush sends any points that are being held for repacking.
+func (r *relay) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, e := range r.encoders {
+		e.flush()
+		delete(r.encoders, key)
+	}
+}
+
+// targets returns the upstreams the packet should be sent to.
+func (r *relay) targets(p *packet.Packet) []io.Writer {
+	if !r.shard || len(r.upstreams) <= 1 {
+		return r.upstreams
+	}
+	h := fnv.New64a()
+	_, _ = io.WriteString(h, p.Application)
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(p.InstanceID)
+	index := h.Sum64() % uint64(len(r.upstreams))
+	return r.upstreams[index : index+1]
+}
+
+// mergeHeaders returns the headers with the extra headers added, replacing any
+// with the same key.
+func mergeHeaders(headers, extra []packet.Header) []packet.Header {
+	if len(extra) == 0 {
+		return headers
+	}
+	out := make([]packet.Header, 0, len(headers)+len(extra))
+outer:
+	for _, header := range headers {
+		for _, e := range extra {
+			if e.Key == header.Key {
+				continue outer
+			}
+		}
+		out = append(out, header)
+	}
+	return append(out, extra...)
+}
+
+// encoderKey returns a key that is the same for packets that can have their
+// points combined.
+func encoderKey(p *packet.Packet) string {
+	var sb strings.Builder
+	writeField := func(s string) {
+		sb.WriteString(s)
+		sb.WriteByte(0)
+	}
+	writeField(p.Application)
+	writeField(string(p.InstanceID))
+	writeField(fmt.Sprintf("%d %d %t %t %t",
+		p.Options.FloatEncoding, p.Options.FixedExponent,
+		p.Options.Labels, p.Options.Distributions, p.Options.VarintLengths))
+	for _, header := range p.Headers {
+		writeField(header.Key)
+		writeField(header.Value)
+	}
+	return sb.String()
+}
+
+// encoder packs points for a single application, instance id, set of headers
+// and options into packets no larger than size.
+type encoder struct {
+	application string
+	instance_id []byte
+	headers     []packet.Header
+	size        int
+	targets     []io.Writer
+
+	w   admproto.Writer
+	buf []byte
+}
+
+// newEncoder returns an encoder for points from packets like p.
+func newEncoder(p *packet.Packet, size int, targets []io.Writer) *encoder {
+	return &encoder{
+		application: p.Application,
+		instance_id: p.InstanceID,
+		headers:     p.Headers,
+		size:        size,
+		targets:     targets,
+
+		// the points are written with the options they were sent with, so
+		// they are no larger and the upstreams can read any packet they
+		// could have read from the sender.
+		w: admproto.NewWriterWith(p.Options),
+	}
+}
+
+// add appends the points, sending packets whenever they are full.
+func (e *encoder) add(points []packet.Point) {
+	var err error
+
+	for _, point := range points {
+		for {
+			// keep track of the buffer before we send
+			before := e.buf
+
+			// always ensure the buffer has the prefix in it.
+			if len(e.buf) == 0 {
+				e.buf, err = e.w.Begin(e.buf, e.application, e.instance_id, len(e.headers))
+				if err != nil {
+					log.Println("dropped packet because", err)
+					e.reset()
+					return
+				}
+				for _, header := range e.headers {
+					e.buf, err = e.w.AppendHeader(e.buf, []byte(header.Key), []byte(header.Value))
+					if err != nil {
+						log.Println("dropped packet because", err)
+						e.reset()
+						return
+					}
+				}
+			}
+
+			// add the value to the buffer
+			if point.Distribution != nil {
+				e.buf, err = e.w.AppendDistribution(e.buf, point.Key, point.Labels, point.Distribution)
+			} else {
+				e.buf, err = e.w.AppendLabeled(e.buf, point.Key, point.Labels, point.Value)
+			}
+			if err != nil {
+				log.Println("skipped point", point.Key, point.Labels, "because", err)
+				e.buf = before
+				break
+			}
+
+			// if we're still in the packet size, then get the next point.
+			if len(e.buf)+4 <= e.size {
+				break
+			}
+
+			// send the previous packet, or this one if it is the only point
+			// in it, and start over.
+			if len(before) == 0 {
+				write(e.targets, admproto.AddChecksum(e.buf))
+			} else {
+				write(e.targets, admproto.AddChecksum(before))
+			}
+			e.reset()
+
+			// if we had no buffer at the start, then we sent this point, so
+			// go on to the next point.
+			if len(before) == 0 {
+				break
+			}
+		}
+	}
+}
+
+// flush sends any partially filled packet.
+func (e *encoder) flush() {
+	if len(e.buf) > 0 {
+		write(e.targets, admproto.AddChecksum(e.buf))
+	}
+	e.reset()
+}
+
+// reset clears the packet being built.
+func (e *encoder) reset() {
+	e.w.Reset()
+	e.buf = e.buf[:0]
+}
+
+// write sends the datagram to every target, logging any errors.
+func write(targets []io.Writer, datagram []byte) {
+	for _, target := range targets {
+		_, err := target.Write(datagram)
+		if err != nil && err != syscall.ENOBUFS {
+			log.Println("failed to forward packet:", err)
+		}
+	}
+}
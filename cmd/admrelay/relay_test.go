@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zeebo/admission/v3"
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/internal/packet"
+	"github.com/zeebo/assert"
+)
+
+// recorder is an upstream that keeps every datagram written to it.
+type recorder struct {
+	mu        sync.Mutex
+	datagrams [][]byte
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.datagrams = append(r.datagrams, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// decoded returns every packet written to the recorder.
+func (r *recorder) decoded(t *testing.T) (out []*packet.Packet) {
+	t.Helper()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, datagram := range r.datagrams {
+		p, err := packet.Decode(datagram)
+		assert.NoError(t, err)
+		out = append(out, p)
+	}
+	return out
+}
+
+// testMessage returns a message holding a packet with a point for each key.
+func testMessage(t *testing.T, application, instance_id string, keys ...string) *admission.Message {
+	t.Helper()
+
+	w := admproto.NewWriterWith(admproto.Options{Labels: true})
+	buf, err := w.Begin(nil, application, []byte(instance_id), 1)
+	assert.NoError(t, err)
+	buf, err = w.AppendHeader(buf, []byte("dc"), []byte("old"))
+	assert.NoError(t, err)
+	for i, key := range keys {
+		buf, err = w.AppendLabeled(buf, key, []admproto.Label{{Key: "k", Value: "v"}}, float64(i))
+		assert.NoError(t, err)
+	}
+	return &admission.Message{Data: admproto.AddChecksum(buf)}
+}
+
+// keys returns the keys of every point in the packets.
+func keys(packets []*packet.Packet) (out []string) {
+	for _, p := range packets {
+		for _, point := range p.Points {
+			out = append(out, point.Key)
+		}
+	}
+	return out
+}
+
+func TestRelay_Passthrough(t *testing.T) {
+	ctx := context.Background()
+	up1, up2 := new(recorder), new(recorder)
+	r := &relay{upstreams: []io.Writer{up1, up2}}
+
+	m := testMessage(t, "app", "inst", "a")
+	r.Handle(ctx, m)
+	assert.DeepEqual(t, up1.datagrams, [][]byte{m.Data})
+	assert.DeepEqual(t, up2.datagrams, [][]byte{m.Data})
+}
+
+func TestRelay_Rewrite(t *testing.T) {
+	ctx := context.Background()
+	up := new(recorder)
+	r := &relay{
+		upstreams:  []io.Writer{up},
+		apps:       map[string]bool{"app": true},
+		prefix:     "keep.",
+		headers:    []packet.Header{{Key: "dc", Value: "new"}, {Key: "region", Value: "r1"}},
+		packetSize: 1024,
+	}
+
+	r.Handle(ctx, testMessage(t, "other", "inst", "keep.a"))
+	r.Handle(ctx, testMessage(t, "app", "inst", "drop.a"))
+	r.Handle(ctx, testMessage(t, "app", "inst", "keep.a", "drop.b", "keep.c"))
+
+	packets := up.decoded(t)
+	assert.Equal(t, len(packets), 1)
+	assert.DeepEqual(t, packets[0].Headers, []packet.Header{
+		{Key: "dc", Value: "new"},
+		{Key: "region", Value: "r1"},
+	})
+	assert.DeepEqual(t, keys(packets), []string{"keep.a", "keep.c"})
+	assert.DeepEqual(t, packets[0].Points[1].Labels, []admproto.Label{{Key: "k", Value: "v"}})
+	assert.Equal(t, packets[0].Points[1].Value, 2.0)
+
+	// the packet is written with the options it was sent with.
+	assert.DeepEqual(t, packets[0].Options, admproto.Options{Labels: true})
+}
+
+func TestRelay_Options(t *testing.T) {
+	ctx := context.Background()
+	up := new(recorder)
+	r := &relay{
+		upstreams:  []io.Writer{up},
+		repack:     true,
+		packetSize: 1024,
+	}
+
+	send := func(opts admproto.Options, key string) {
+		w := admproto.NewWriterWith(opts)
+		buf, err := w.Begin(nil, "app", []byte("inst"), 0)
+		assert.NoError(t, err)
+		buf, err = w.Append(buf, key, 1.5)
+		assert.NoError(t, err)
+		r.Handle(ctx, &admission.Message{Data: admproto.AddChecksum(buf)})
+	}
+
+	// packets with different options are not combined, and keep them.
+	fixed := admproto.Options{FloatEncoding: admproto.FixedEncoding, FixedExponent: -1}
+	send(admproto.Options{}, "a")
+	send(fixed, "b")
+	send(admproto.Options{}, "c")
+	r.flush()
+
+	byKeys := make(map[string]admproto.Options)
+	for _, p := range up.decoded(t) {
+		byKeys[strings.Join(keys([]*packet.Packet{p}), ",")] = p.Options
+	}
+	assert.DeepEqual(t, byKeys, map[string]admproto.Options{
+		"a,c": {},
+		"b":   fixed,
+	})
+}
+
+func TestRelay_DeltaFrame(t *testing.T) {
+	ctx := context.Background()
+	up := new(recorder)
+	r := &relay{
+		upstreams:  []io.Writer{up},
+		prefix:     "keep.",
+		headers:    []packet.Header{{Key: "dc", Value: "new"}},
+		packetSize: 1024,
+	}
+
+	state := admproto.NewDeltaState(10)
+	send := func(value float64) {
+		state.Advance()
+		w := admproto.NewWriterWith(admproto.Options{Delta: state})
+		buf, err := w.Begin(nil, "app", []byte("inst"), 1)
+		assert.NoError(t, err)
+		buf, err = w.AppendHeader(buf, []byte("dc"), []byte("old"))
+		assert.NoError(t, err)
+		buf, err = w.Append(buf, "drop.a", value)
+		assert.NoError(t, err)
+		r.Handle(ctx, &admission.Message{Data: admproto.AddChecksum(buf)})
+	}
+	send(1)
+	send(2)
+
+	// the headers are rewritten, but the points are forwarded as they are
+	// and can still be resolved against the keyframe.
+	packets := up.decoded(t)
+	assert.Equal(t, len(packets), 2)
+	assert.Equal(t, packets[0].Frame, admproto.Keyframe)
+	assert.Equal(t, packets[1].Frame, admproto.DeltaFrame)
+	for _, p := range packets {
+		assert.DeepEqual(t, p.Headers, []packet.Header{{Key: "dc", Value: "new"}})
+		assert.DeepEqual(t, keys([]*packet.Packet{p}), []string{"drop.a"})
+	}
+	assert.That(t, packets[1].Points[0].Delta)
+	assert.Equal(t, packets[1].Points[0].Value, 1.0)
+	assert.Equal(t, r.unfiltered, int64(2))
+}
+
+func TestRelay_Repack(t *testing.T) {
+	ctx := context.Background()
+	up := new(recorder)
+	r := &relay{
+		upstreams:  []io.Writer{up},
+		repack:     true,
+		packetSize: 1024,
+	}
+
+	r.Handle(ctx, testMessage(t, "app", "inst", "a", "b"))
+	r.Handle(ctx, testMessage(t, "app", "inst", "c"))
+	r.Handle(ctx, testMessage(t, "app", "other", "d"))
+	assert.Equal(t, len(up.datagrams), 0)
+
+	r.flush()
+	packets := up.decoded(t)
+	assert.Equal(t, len(packets), 2)
+
+	byInstance := make(map[string][]string)
+	for _, p := range packets {
+		byInstance[string(p.InstanceID)] = keys([]*packet.Packet{p})
+	}
+	assert.DeepEqual(t, byInstance, map[string][]string{
+		"inst":  {"a", "b", "c"},
+		"other": {"d"},
+	})
+
+	// small packet sizes split the points up.
+	r.packetSize = 40
+	r.Handle(ctx, testMessage(t, "app", "inst", "a", "b", "c", "d", "e", "f"))
+	r.flush()
+	packets = up.decoded(t)[2:]
+	assert.That(t, len(packets) > 1)
+	for _, datagram := range up.datagrams[2:] {
+		assert.That(t, len(datagram) <= 40)
+	}
+	assert.DeepEqual(t, keys(packets), []string{"a", "b", "c", "d", "e", "f"})
+}
+
+func TestRelay_Shard(t *testing.T) {
+	ctx := context.Background()
+	ups := []*recorder{new(recorder), new(recorder), new(recorder)}
+	r := &relay{
+		upstreams: []io.Writer{ups[0], ups[1], ups[2]},
+		shard:     true,
+	}
+
+	for i := 0; i < 20; i++ {
+		r.Handle(ctx, testMessage(t, "app", string(rune('a'+i)), "x"))
+		r.Handle(ctx, testMessage(t, "app", string(rune('a'+i)), "y"))
+	}
+
+	// every instance goes to exactly one upstream, and the instances are
+	// spread across more than one.
+	total, used := 0, 0
+	for _, up := range ups {
+		seen := make(map[string]int)
+		for _, p := range up.decoded(t) {
+			seen[string(p.InstanceID)]++
+		}
+		for _, count := range seen {
+			assert.Equal(t, count, 2)
+		}
+		total += len(up.datagrams)
+		if len(up.datagrams) > 0 {
+			used++
+		}
+	}
+	assert.Equal(t, total, 40)
+	assert.That(t, used > 1)
+}
+
+func TestCloseUpstream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	// the packets queued in a stream are sent before it is closed.
+	upstream, err := dialUpstream("tcp://" + listener.Addr().String())
+	assert.NoError(t, err)
+	m := testMessage(t, "app", "inst", "a")
+	_, err = upstream.Write(m.Data)
+	assert.NoError(t, err)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		assert.NoError(t, err)
+		accepted <- conn
+	}()
+	closeUpstream(upstream)
+
+	conn := <-accepted
+	defer conn.Close()
+	datagram, err := admproto.ReadFrame(conn, make([]byte, 1024))
+	assert.NoError(t, err)
+	assert.DeepEqual(t, datagram, m.Data)
+}
@@ -0,0 +1,92 @@
+// admreplay sends the packets in a capture file to an address, keeping their
+// original timing or speeding it up.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/zeebo/admission/v3"
+	"github.com/zeebo/admission/v3/internal/packet"
+	"github.com/zeebo/errs"
+)
+
+var (
+	fileFlag = flag.String("file", "",
+		"capture file to replay")
+	targetFlag = flag.String("target", "",
+		"address to send to: a udp host:port or unixgram://path")
+	speedFlag = flag.Float64("speed", 1,
+		"how much faster than recorded to replay, or zero for as fast as possible")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "admreplay:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *fileFlag == "" || *targetFlag == "" {
+		return errs.New("-file and -target are required")
+	}
+	if *speedFlag < 0 {
+		return errs.New("-speed must not be negative")
+	}
+
+	fh, err := os.Open(*fileFlag)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer func() { _ = fh.Close() }()
+
+	conn, err := packet.Dial(*targetFlag)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	s := &sender{conn: conn}
+	err = admission.Replay{Handler: s, Speed: *speedFlag}.Run(ctx, fh)
+	log.Printf("sent %d packets (%d failed)", s.sent, s.failed)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// sender is an admission.Handler that writes every message to a connection.
+// Replay calls it one message at a time, so it needs no locking.
+type sender struct {
+	conn   net.Conn
+	sent   int
+	failed int
+}
+
+// Handle implements admission.Handler.
+func (s *sender) Handle(ctx context.Context, m *admission.Message) {
+	if _, err := s.conn.Write(m.Data); err != nil {
+		s.failed++
+		return
+	}
+	s.sent++
+}
@@ -3,7 +3,6 @@ package admission
 
 import (
 	"context"
-	"sync"
 
 	"github.com/zeebo/admission/v3/internal/batch"
 )
@@ -11,16 +10,15 @@ import (
 // Handler is a type that can handle messages.
 type Handler interface {
 	// Handle should do things with the message Data. No fields of the message
-	// should be held on to after the call has returned.
+	// should be held on to after the call has returned unless the message is
+	// kept with Retain, in which case Release must be called once it is no
+	// longer used.
 	Handle(ctx context.Context, m *Message)
 }
 
 // Message is what is handled by a handler.
 type Message = batch.Message
 
-var messagePool = sync.Pool{
-	New: func() interface{} { return new(Message) },
-}
-
-func getMessage() *Message  { return messagePool.Get().(*Message) }
-func putMessage(m *Message) { messagePool.Put(m) }
+// getMessage returns a Message from the pool with a single reference, which
+// is released with its Release method.
+func getMessage() *Message { return batch.Get() }
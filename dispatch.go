@@ -2,9 +2,11 @@ package admission
 
 import (
 	"context"
+	"io"
 	"syscall"
+	"time"
 
-	"github.com/zeebo/admission/v3/internal/batch"
+	"github.com/zeebo/admission/v3/admproto"
 	"github.com/zeebo/errs"
 )
 
@@ -18,13 +20,34 @@ const (
 	DefaultInFlight = 256
 )
 
-// Dispatcher reads Messages on the PacketConn and forwards them into the
+// Dispatcher reads Messages from a PacketSource and forwards them into the
 // Handler in parallel.
 type Dispatcher struct {
 	// Handler is an interface called with each read Message.
 	Handler Handler
 
-	// Conn is the connection the packets are read from.
+	// BatchHandler, if set, is called with batches of Messages instead of
+	// calling the Handler with each one. Each call counts once against the
+	// InFlight limit, and if it would go over, the whole batch is dropped.
+	BatchHandler BatchHandler
+
+	// BatchSize is the most Messages passed to a single call to the
+	// BatchHandler. Zero is the number of messages read at once.
+	BatchSize int
+
+	// BatchWindow is how long to wait for more Messages to fill a batch. If
+	// zero, the Messages from every read are passed to the BatchHandler
+	// without waiting. With a window, the drop hooks may be called from
+	// another goroutine than the one calling Run.
+	BatchWindow time.Duration
+
+	// Source is where the packets are read from. If nil, they are read from
+	// Conn instead.
+	Source PacketSource
+
+	// Conn is the connection the packets are read from if Source is nil. It
+	// can come from either a UDP or a unix datagram socket. It is the same as
+	// using a RawConnSource.
 	Conn syscall.RawConn
 
 	// NumMessages is the number of messages to attempt to read at once. If
@@ -32,21 +55,81 @@ type Dispatcher struct {
 	NumMessages int
 
 	// InFlight controls the number of parallel calls to the Handler. Zero is
-	// DefaultInFlight.
+	// DefaultInFlight. When the order of Messages is preserved, it includes
+	// the Messages waiting for a worker.
 	InFlight int
 
+	// Ordering controls if Messages from the same sender are handled in the
+	// order they arrived. If zero, they are Unordered. It cannot be used with
+	// a BatchHandler.
+	Ordering Ordering
+
+	// Workers is the number of goroutines calling the Handler when Ordering
+	// is set. Messages from a sender are always handled by the same worker.
+	// Zero is DefaultWorkers.
+	Workers int
+
+	// VerifyChecksums causes Messages with an invalid checksum to be dropped
+	// before they are passed to the Handler.
+	VerifyChecksums bool
+
+	// SourceLimit limits the rate of Messages from every sending host. Over
+	// the limit, Messages are dropped before they are passed to the Handler.
+	// Messages with no known sender share a single limit. Messages dropped
+	// because the InFlight limit was reached do not count against it.
+	SourceLimit Limit
+
+	// InstanceLimit limits the rate of Messages from every application and
+	// instance id. Over the limit, Messages are dropped before they are
+	// passed to the Handler. Messages that cannot be parsed share a single
+	// limit. Like SourceLimit, Messages dropped because the InFlight limit was
+	// reached do not count against it.
+	InstanceLimit Limit
+
+	// Stats, if set, collects statistics about reads, drops and calls to the
+	// Handler.
+	Stats *Stats
+
+	// OnReadError decides what to do when reading from the source returns an
+	// error. If nil, ClassifyReadError is used.
+	OnReadError func(ctx context.Context, err error) ReadErrorAction
+
+	// RecoverPanics causes panics in the Handler to be recovered and
+	// reported to the HandlerPanic hook instead of crashing the process.
+	RecoverPanics bool
+
 	// Hooks provide callbacks for events in the dispatcher.
 	Hooks struct {
 		// when messages were read with how many.
 		ReadMessages func(ctx context.Context, n int)
 		// when a message is dropped.
 		DroppedMessage func(ctx context.Context)
+		// when a message is dropped, with why and the message. the message
+		// must not be modified or held on to after the call has returned.
+		Dropped func(ctx context.Context, reason DropReason, m *Message)
+		// when the Handler panics and RecoverPanics is set, with the value
+		// passed to panic and the data of the message. The data must not be
+		// held on to after the call has returned, and is nil if it was the
+		// BatchHandler that panicked.
+		HandlerPanic func(ctx context.Context, value interface{}, data []byte)
 	}
 }
 
 // Run reads messages and passes them to the handler in their own goroutines
-// until the context is cancelled.
+// until the context is cancelled or the source returns io.EOF.
 func (d Dispatcher) Run(ctx context.Context) (err error) {
+	source := d.Source
+	if source == nil {
+		if d.Conn == nil {
+			return errs.New("dispatcher has no source")
+		}
+		source = RawConnSource{Conn: d.Conn}
+	}
+
+	if d.BatchHandler != nil && d.Ordering != Unordered {
+		return errs.New("dispatcher cannot order messages for a batch handler")
+	}
+
 	num_messages := d.NumMessages
 	if num_messages == 0 {
 		num_messages = DefaultMessages
@@ -59,7 +142,36 @@ func (d Dispatcher) Run(ctx context.Context) (err error) {
 	done := ctx.Done()
 	msgs := make([]*Message, num_messages)
 	sem := make(chan struct{}, in_flight)
+	on_read_error := d.OnReadError
+	if on_read_error == nil {
+		on_read_error = func(ctx context.Context, err error) ReadErrorAction {
+			return ClassifyReadError(err)
+		}
+	}
+
+	lims := limits{
+		source:   d.SourceLimit.limiter(),
+		instance: d.InstanceLimit.limiter(),
+	}
+	limited := lims.source != nil || lims.instance != nil
 
+	var batches *batcher
+	if d.BatchHandler != nil {
+		batch_size := d.BatchSize
+		if batch_size == 0 {
+			batch_size = num_messages
+		}
+		batches = d.newBatcher(ctx, sem, lims, batch_size)
+		defer batches.close(ctx)
+	}
+
+	var queues []chan *Message
+	if d.Ordering != Unordered {
+		queues = d.startWorkers(ctx, sem)
+		defer closeQueues(queues)
+	}
+
+	var backoff time.Duration
 	for {
 		// check our context.
 		//
@@ -73,43 +185,158 @@ func (d Dispatcher) Run(ctx context.Context) (err error) {
 		}
 
 		// fill in any nil messages, and build up the Message array for
-		// passing to batch.Read.
+		// passing to the source. messages left over from dropping are
+		// cleared of anything the source may not set.
 		for i := range msgs {
 			if msgs[i] == nil {
 				msgs[i] = getMessage()
+			} else {
+				msgs[i].SetTruncated(false)
+			}
+		}
+
+		n, err := source.ReadMessages(msgs)
+		if err != nil && err != io.EOF {
+			if d.Stats != nil {
+				d.Stats.readError()
+			}
+
+			switch on_read_error(ctx, err) {
+			case ReadErrorContinue:
+				continue
+			case ReadErrorBackoff:
+				var ok bool
+				if backoff, ok = readBackoff(ctx, backoff); !ok {
+					return nil
+				}
+				continue
+			default:
+				return errs.Wrap(err)
 			}
 		}
+		backoff = 0
 
-		n, err := batch.Read(d.Conn, msgs)
-		if err != nil {
-			return errs.Wrap(err)
+		if d.Stats != nil && n > 0 {
+			d.Stats.read(n, len(msgs))
 		}
 		if d.Hooks.ReadMessages != nil {
 			d.Hooks.ReadMessages(ctx, n)
 		}
 
+		// if we were cancelled while reading, nothing read will be handled.
+		select {
+		case <-done:
+			for i := 0; i < n; i++ {
+				d.dropMessage(ctx, DropShutdown, msgs[i])
+			}
+			return nil
+		default:
+		}
+
+		var now time.Time
+		if limited && n > 0 {
+			now = time.Now()
+		}
+
 		// fix up the Data slices, pass them off to be handled in a goroutine
 		// and clear them out of the in array for the next round of packets.
 		for i := 0; i < n; i++ {
+			if reason, ok := d.admit(lims, msgs[i], now); !ok {
+				d.dropMessage(ctx, reason, msgs[i])
+				continue
+			}
+
+			if batches != nil {
+				batches.push(ctx, msgs[i])
+				msgs[i] = nil
+				continue
+			}
+
 			select {
 			case sem <- struct{}{}:
-				go handleMessage(ctx, sem, d.Handler, msgs[i])
+				if d.Stats != nil {
+					d.Stats.start()
+				}
+				if queues != nil {
+					queues[d.Ordering.shard(msgs[i], len(queues))] <- msgs[i]
+				} else {
+					go d.handleMessage(ctx, sem, msgs[i])
+				}
 				msgs[i] = nil
 			default:
-				if d.Hooks.DroppedMessage != nil {
-					d.Hooks.DroppedMessage(ctx)
-				}
+				lims.refund(msgs[i])
+				d.dropMessage(ctx, DropOverloaded, msgs[i])
 			}
 		}
+		if batches != nil {
+			batches.endRead(ctx)
+		}
+
+		// the source has nothing left, so we're done.
+		if err == io.EOF {
+			return nil
+		}
 	}
 }
 
-// handleMessage passes the message to the handler and returns it to the pool
-// once it is done.
-func handleMessage(ctx context.Context, sem chan struct{}, h Handler,
-	m *Message) {
+// admit returns the reason the message should be dropped and false if it
+// should not be passed to the handler.
+func (d *Dispatcher) admit(lims limits, m *Message, now time.Time) (DropReason, bool) {
+	if m.Truncated() {
+		return DropTruncated, false
+	}
+	if d.VerifyChecksums {
+		if _, err := admproto.CheckChecksum(m.Data); err != nil {
+			return DropInvalidChecksum, false
+		}
+	}
+	if lims.source != nil || lims.instance != nil {
+		return lims.check(m, now)
+	}
+	return 0, true
+}
+
+// dropMessage records that the message was dropped for the reason.
+func (d *Dispatcher) dropMessage(ctx context.Context, reason DropReason, m *Message) {
+	if d.Stats != nil {
+		d.Stats.drop(reason)
+	}
+	if d.Hooks.DroppedMessage != nil {
+		d.Hooks.DroppedMessage(ctx)
+	}
+	if d.Hooks.Dropped != nil {
+		d.Hooks.Dropped(ctx, reason, m)
+	}
+}
+
+// handleMessage passes the message to the handler and releases it once it is
+// done, recording how long it took if there are stats.
+func (d *Dispatcher) handleMessage(ctx context.Context, sem chan struct{}, m *Message) {
+	var start time.Time
+	if d.Stats != nil {
+		start = time.Now()
+	}
+	defer func() {
+		<-sem
+		if d.Stats != nil {
+			d.Stats.done(time.Since(start))
+		}
+	}()
+
+	if d.RecoverPanics {
+		defer func() {
+			if value := recover(); value != nil {
+				if d.Stats != nil {
+					d.Stats.panicked()
+				}
+				if d.Hooks.HandlerPanic != nil {
+					d.Hooks.HandlerPanic(ctx, value, m.Data)
+				}
+				m.Release()
+			}
+		}()
+	}
 
-	h.Handle(ctx, m)
-	putMessage(m)
-	<-sem
+	d.Handler.Handle(ctx, m)
+	m.Release()
 }
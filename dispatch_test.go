@@ -0,0 +1,164 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zeebo/admission/v3/admtest"
+	"github.com/zeebo/assert"
+	"github.com/zeebo/errs"
+)
+
+// runDispatcher runs the Dispatcher in the background and returns a function
+// that stops it and returns the error from Run.
+func runDispatcher(t *testing.T, d Dispatcher, conn *admtest.Conn) (stop func() error) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- d.Run(ctx) }()
+
+	return func() error {
+		cancel()
+		_ = conn.Close()
+		select {
+		case err := <-errc:
+			return err
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the dispatcher")
+			return nil
+		}
+	}
+}
+
+// waitContext returns a context that times out so that tests don't hang.
+func waitContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// sortedData returns the handled data as sorted strings.
+func sortedData(h *admtest.Handler) (out []string) {
+	for _, data := range h.Data() {
+		out = append(out, string(data))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestDispatcher(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+
+	var reads, read int64
+	d := Dispatcher{Handler: handler, Source: conn}
+	d.Hooks.ReadMessages = func(ctx context.Context, n int) {
+		atomic.AddInt64(&reads, 1)
+		atomic.AddInt64(&read, int64(n))
+	}
+
+	for _, data := range []string{"a", "b", "c", "d", "e"} {
+		conn.Send([]byte(data))
+	}
+
+	stop := runDispatcher(t, d, conn)
+	assert.NoError(t, handler.Wait(waitContext(t), 5))
+	assert.Error(t, stop())
+
+	assert.DeepEqual(t, sortedData(handler), []string{"a", "b", "c", "d", "e"})
+	assert.Equal(t, atomic.LoadInt64(&read), int64(5))
+	assert.Equal(t, atomic.LoadInt64(&reads), int64(1))
+}
+
+func TestDispatcher_Batches(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+
+	var sizes []int
+	d := Dispatcher{Handler: handler, Source: conn, NumMessages: 2}
+	d.Hooks.ReadMessages = func(ctx context.Context, n int) { sizes = append(sizes, n) }
+
+	for _, data := range []string{"a", "b", "c", "d", "e"} {
+		conn.Send([]byte(data))
+	}
+
+	stop := runDispatcher(t, d, conn)
+	assert.NoError(t, handler.Wait(waitContext(t), 5))
+	assert.Error(t, stop())
+
+	assert.DeepEqual(t, sizes, []int{2, 2, 1})
+}
+
+func TestDispatcher_Dropped(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := &admtest.Handler{Gate: make(chan struct{})}
+
+	var dropped int64
+	d := Dispatcher{Handler: handler, Source: conn, InFlight: 1}
+	d.Hooks.DroppedMessage = func(ctx context.Context) { atomic.AddInt64(&dropped, 1) }
+
+	// all three are read at once, but only one can be in flight.
+	conn.Send([]byte("a"))
+	conn.Send([]byte("b"))
+	conn.Send([]byte("c"))
+
+	stop := runDispatcher(t, d, conn)
+	ctx := waitContext(t)
+	assert.NoError(t, handler.WaitStarted(ctx, 1))
+
+	// once the handler returns, more messages can be handled.
+	handler.Gate <- struct{}{}
+	assert.NoError(t, handler.Wait(ctx, 1))
+	conn.Send([]byte("d"))
+	handler.Gate <- struct{}{}
+	assert.NoError(t, handler.Wait(ctx, 2))
+	assert.Error(t, stop())
+
+	assert.DeepEqual(t, sortedData(handler), []string{"a", "d"})
+	assert.Equal(t, atomic.LoadInt64(&dropped), int64(2))
+}
+
+func TestDispatcher_ReadError(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+	failure := errors.New("failure")
+
+	conn.Send([]byte("a"))
+	conn.Fail(failure)
+	conn.Send([]byte("b"))
+
+	err := Dispatcher{Handler: handler, Source: conn}.Run(context.Background())
+	assert.Equal(t, errs.Unwrap(err), failure)
+
+	// the packet before the error was handled and the one after is unread.
+	assert.NoError(t, handler.Wait(waitContext(t), 1))
+	assert.DeepEqual(t, sortedData(handler), []string{"a"})
+	assert.Equal(t, conn.Pending(), 1)
+}
+
+func TestDispatcher_Wakeups(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+
+	var reads int64
+	d := Dispatcher{Handler: handler, Source: conn}
+	d.Hooks.ReadMessages = func(ctx context.Context, n int) { atomic.AddInt64(&reads, 1) }
+
+	// spurious wakeups are retried without the dispatcher seeing them.
+	conn.Wakeup()
+	conn.Wakeup()
+	conn.Wakeup()
+	conn.Send([]byte("a"))
+
+	stop := runDispatcher(t, d, conn)
+	assert.NoError(t, handler.Wait(waitContext(t), 1))
+	assert.Error(t, stop())
+
+	assert.Equal(t, conn.Wakeups(), 3)
+	assert.Equal(t, atomic.LoadInt64(&reads), int64(1))
+}
@@ -0,0 +1,87 @@
+package admission
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/admtest"
+	"github.com/zeebo/assert"
+)
+
+func TestDispatcher_DropReasons(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+	stats := new(Stats)
+	drops := new(dropRecorder)
+
+	var old int64
+	var datas []string
+	d := Dispatcher{
+		Handler:         handler,
+		Source:          conn,
+		VerifyChecksums: true,
+		Stats:           stats,
+	}
+	d.Hooks.DroppedMessage = func(ctx context.Context) { atomic.AddInt64(&old, 1) }
+	d.Hooks.Dropped = func(ctx context.Context, reason DropReason, m *Message) {
+		datas = append(datas, string(m.Data))
+		drops.dropped(ctx, reason, m)
+	}
+
+	valid := admproto.AddChecksum([]byte("valid"))
+	conn.Send(valid)
+	conn.Send([]byte("invalid"))
+	conn.Send(admproto.AddChecksum(bytes.Repeat([]byte("x"), 2000)))
+	assert.NoError(t, conn.Close())
+
+	assert.Error(t, d.Run(waitContext(t)))
+	assert.NoError(t, handler.Wait(waitContext(t), 1))
+
+	assert.DeepEqual(t, handler.Data(), [][]byte{valid})
+	assert.Equal(t, drops.count(DropInvalidChecksum), 1)
+	assert.Equal(t, drops.count(DropTruncated), 1)
+	assert.Equal(t, datas[0], "invalid")
+
+	// the old hook still sees every drop.
+	assert.Equal(t, atomic.LoadInt64(&old), int64(2))
+
+	snap := stats.Snapshot()
+	assert.Equal(t, snap.Dropped, int64(2))
+	assert.Equal(t, snap.Drops[DropInvalidChecksum], int64(1))
+	assert.Equal(t, snap.Drops[DropTruncated], int64(1))
+}
+
+// cancelSource reads a packet from the Conn and then cancels the context, as
+// if the context was cancelled while the read was blocked.
+type cancelSource struct {
+	conn   *admtest.Conn
+	cancel func()
+}
+
+func (c cancelSource) ReadMessages(msgs []*Message) (int, error) {
+	n, err := c.conn.ReadMessages(msgs)
+	c.cancel()
+	return n, err
+}
+
+func TestDispatcher_DropShutdown(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+	drops := new(dropRecorder)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := Dispatcher{Handler: handler, Source: cancelSource{conn: conn, cancel: cancel}}
+	d.Hooks.Dropped = drops.dropped
+
+	conn.Send([]byte("a"))
+	conn.Send([]byte("b"))
+
+	assert.NoError(t, d.Run(ctx))
+	assert.Equal(t, handler.Started(), 0)
+	assert.Equal(t, drops.count(DropShutdown), 2)
+}
@@ -0,0 +1,7 @@
+// +build admdebug
+
+package batch
+
+// debug causes released Messages to be poisoned and kept out of the pool, and
+// uses of them to panic.
+const debug = true
@@ -0,0 +1,6 @@
+// +build !admdebug
+
+package batch
+
+// debug is off unless built with the admdebug tag.
+const debug = false
@@ -1,5 +1,12 @@
 package batch
 
+import (
+	"net"
+)
+
+// nameSize is large enough to hold any socket address the kernel reports.
+const nameSize = 112
+
 // Message is what we read from/to.
 type Message struct {
 	// buf contains the data that the Data slice will point at.
@@ -13,4 +20,95 @@ type Message struct {
 
 	// inlined to avoid allocations during reading
 	iovec iovec
+
+	// name is the raw socket address of the sender on platforms that report
+	// it, and nameLen is how much of it is valid. it is only decoded when
+	// asked for to avoid allocations during reading.
+	name    [nameSize]byte
+	nameLen uint32
+
+	// source is the sender when set explicitly, and wins over name.
+	source net.Addr
+
+	// truncated is set when the packet did not fit in buf.
+	truncated bool
+
+	// refs is the number of references to the Message beyond the first, or
+	// -1 once it has been released. pooled is set if it came from the pool.
+	refs   int32
+	pooled bool
+}
+
+// Buffer returns the storage that Data points into. Sources of Messages other
+// than sockets can read into it and then set Data to the part that was read.
+func (m *Message) Buffer() []byte {
+	m.checkLive()
+	return m.buf[:]
+}
+
+// Source returns the address of the sender of the Message, or nil if it is
+// not known. Messages read from sockets only have it on linux/amd64.
+func (m *Message) Source() net.Addr {
+	m.checkLive()
+	if m.source != nil {
+		return m.source
+	}
+	if m.nameLen > 0 && m.nameLen <= nameSize {
+		return decodeName(m.name[:m.nameLen])
+	}
+	return nil
+}
+
+// SetSource sets the address of the sender of the Message. Sources of
+// Messages other than sockets can use it to record where they came from.
+func (m *Message) SetSource(addr net.Addr) {
+	m.checkLive()
+	m.source = addr
+	m.nameLen = 0
+}
+
+// Truncated returns true if the packet was larger than the buffer and Data
+// only holds the start of it. It is only known on linux/amd64 and windows.
+func (m *Message) Truncated() bool {
+	m.checkLive()
+	return m.truncated
+}
+
+// SetTruncated sets if the packet was larger than the buffer. Sources of
+// Messages other than sockets can use it to report packets that did not fit.
+func (m *Message) SetTruncated(truncated bool) {
+	m.checkLive()
+	m.truncated = truncated
+}
+
+// AppendSourceKey appends bytes identifying the host that sent the Message,
+// ignoring any port, so that Messages can be grouped by sender without
+// decoding the address. Nothing is appended if the sender is not known.
+func (m *Message) AppendSourceKey(buf []byte) []byte {
+	m.checkLive()
+	if m.source != nil {
+		switch addr := m.source.(type) {
+		case *net.UDPAddr:
+			return appendIPKey(buf, addr.IP)
+		case *net.TCPAddr:
+			return appendIPKey(buf, addr.IP)
+		case *net.UnixAddr:
+			return append(append(buf, 'u'), addr.Name...)
+		default:
+			return append(append(buf, 's'), addr.String()...)
+		}
+	}
+	if m.nameLen > 0 && m.nameLen <= nameSize {
+		return appendNameKey(buf, m.name[:m.nameLen])
+	}
+	return buf
+}
+
+// appendIPKey appends the key for the IP, using the 16 byte form so that IPv4
+// addresses have the same key however they are stored.
+func appendIPKey(buf []byte, ip net.IP) []byte {
+	if ip16 := ip.To16(); ip16 != nil {
+		return append(append(buf, 'i'), ip16...)
+	}
+	return buf
 }
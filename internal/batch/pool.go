@@ -0,0 +1,70 @@
+package batch
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// poison is written over the buffer of a released Message in debug builds so
+// that data read after release is obviously wrong.
+const poison = 0xdd
+
+var messagePool = sync.Pool{
+	New: func() interface{} { return new(Message) },
+}
+
+// Get returns a Message from the pool. The caller holds the only reference to
+// it, and it is returned to the pool once every reference is released.
+func Get() *Message {
+	m := messagePool.Get().(*Message)
+	atomic.StoreInt32(&m.refs, 0)
+	m.pooled = true
+	return m
+}
+
+// Retain adds a reference to the Message so that it is not returned to the
+// pool until Release has been called once for the reference, in addition to
+// once by whoever passed it along. A Handler can use it to keep the Message
+// after Handle returns. It panics if the Message has already been released.
+func (m *Message) Retain() {
+	if atomic.AddInt32(&m.refs, 1) <= 0 {
+		panic("admission: retain of released message")
+	}
+}
+
+// Release removes a reference to the Message. Once the last reference is
+// removed, the Message must not be used again, and if it came from the pool it
+// is returned there. It panics if the Message has already been released.
+func (m *Message) Release() {
+	refs := atomic.AddInt32(&m.refs, -1)
+	switch {
+	case refs >= 0:
+		return
+	case refs < -1:
+		panic("admission: release of released message")
+	}
+
+	if debug {
+		// keep poisoned messages out of the pool so that any use of them
+		// after release stays detectable.
+		for i := range m.buf {
+			m.buf[i] = poison
+		}
+		return
+	}
+
+	if m.pooled {
+		m.Data = nil
+		m.source = nil
+		m.nameLen = 0
+		m.truncated = false
+		messagePool.Put(m)
+	}
+}
+
+// checkLive panics in debug builds if the Message has been released.
+func (m *Message) checkLive() {
+	if debug && atomic.LoadInt32(&m.refs) < 0 {
+		panic("admission: use of released message")
+	}
+}
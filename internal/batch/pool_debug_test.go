@@ -0,0 +1,30 @@
+// +build admdebug
+
+package batch
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMessage_ReleaseDebug(t *testing.T) {
+	m := Get()
+	m.Data = append(m.Buffer()[:0], "hello"...)
+	data := m.Data
+	m.Release()
+
+	// the data is poisoned and the message can't be used.
+	if !bytes.Equal(data, bytes.Repeat([]byte{poison}, len(data))) {
+		t.Fatalf("data: %q", data)
+	}
+	assertPanics(t, func() { m.Buffer() })
+	assertPanics(t, func() { m.Source() })
+	assertPanics(t, func() { m.Truncated() })
+
+	// and it is never handed out again.
+	for i := 0; i < 100; i++ {
+		if Get() == m {
+			t.Fatal("released message reused")
+		}
+	}
+}
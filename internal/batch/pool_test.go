@@ -0,0 +1,42 @@
+package batch
+
+import (
+	"testing"
+)
+
+// assertPanics fails the test if f does not panic.
+func assertPanics(t *testing.T, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	f()
+}
+
+func TestMessage_Retain(t *testing.T) {
+	m := Get()
+	m.Data = append(m.Buffer()[:0], "hello"...)
+
+	// a retained message survives the first release.
+	m.Retain()
+	m.Release()
+	if string(m.Data) != "hello" || m.Buffer() == nil {
+		t.Fatalf("data: %q", m.Data)
+	}
+
+	// once every reference is released, it can't be used.
+	m.Release()
+	assertPanics(t, m.Release)
+	assertPanics(t, m.Retain)
+}
+
+func TestMessage_RetainUnpooled(t *testing.T) {
+	// messages not from the pool count references too.
+	var m Message
+	m.Retain()
+	m.Release()
+	m.Release()
+	assertPanics(t, m.Release)
+}
@@ -1,6 +1,8 @@
 package batch
 
 import (
+	"encoding/binary"
+	"net"
 	"sync"
 	"syscall"
 	"unsafe"
@@ -34,11 +36,16 @@ func Read(sc syscall.RawConn, msgs []*Message) (int, error) {
 	for i := range msgs {
 		msgs[i].iovec.Base = &msgs[i].buf[0]
 		msgs[i].iovec.Len = uint64(len(msgs[i].buf))
+		msgs[i].source = nil
+		msgs[i].nameLen = 0
+		msgs[i].truncated = false
 
 		hdrs[i] = mmsghdr{
 			Hdr: msghdr{
-				Iov:    &msgs[i].iovec,
-				Iovlen: 1,
+				Name:    &msgs[i].name[0],
+				Namelen: nameSize,
+				Iov:     &msgs[i].iovec,
+				Iovlen:  1,
 			},
 			Len: 0,
 		}
@@ -53,9 +60,10 @@ func Read(sc syscall.RawConn, msgs []*Message) (int, error) {
 	// allocations (the op struct, and the closure) when the pool misses, but
 	// we don't need to do an allocation for every Read when the pool hits.
 	type op struct {
-		m    func(uintptr) bool
-		hdrs []mmsghdr
-		n    int
+		m     func(uintptr) bool
+		hdrs  []mmsghdr
+		n     int
+		errno syscall.Errno
 	}
 
 	// get and initialize a *op from the pool
@@ -63,17 +71,17 @@ func Read(sc syscall.RawConn, msgs []*Message) (int, error) {
 	if o == nil {
 		o = new(op)
 		o.m = func(fd uintptr) bool {
-			var operr syscall.Errno
-			o.n, operr = recvmmsg(fd, o.hdrs)
-			return operr != syscall.EAGAIN
+			o.n, o.errno = recvmmsg(fd, o.hdrs)
+			return o.errno != syscall.EAGAIN
 		}
 	}
 	o.hdrs = hdrs
 	o.n = 0
+	o.errno = 0
 
 	// issue the Read call and look at the results
 	err := sc.Read(o.m)
-	n := o.n
+	n, errno := o.n, o.errno
 
 	// replace the op. we clear hdrs here to avoid keeping them alive inside
 	// of the pool if possible.
@@ -81,12 +89,20 @@ func Read(sc syscall.RawConn, msgs []*Message) (int, error) {
 	opPool.Put(o)
 
 	if err != nil {
-		return n, err
+		return 0, err
+	}
+	// the syscall failed with something other than EAGAIN, like
+	// ECONNREFUSED from an earlier ICMP error, and read nothing.
+	if errno != 0 {
+		hdrPool.Put(hdrs_p)
+		return 0, errno
 	}
 
 	// read the results into the msgs
 	for i := range msgs[:n] {
 		msgs[i].Data = msgs[i].buf[:hdrs[i].Len]
+		msgs[i].nameLen = hdrs[i].Hdr.Namelen
+		msgs[i].truncated = hdrs[i].Hdr.Flags&syscall.MSG_TRUNC != 0
 	}
 
 	// we no longer need the mmsghdrs. return them for another call
@@ -108,15 +124,98 @@ type mmsghdr struct {
 }
 
 type msghdr struct {
-	_      *byte   // Name
-	_      uint32  // Name len
-	_      [4]byte // padding
-	Iov    *iovec
-	Iovlen uint64
-	_      *byte   // Control
-	_      uint64  // Control len
-	_      int32   // Flags
-	_      [4]byte // padding
+	Name    *byte
+	Namelen uint32
+	_       [4]byte // padding
+	Iov     *iovec
+	Iovlen  uint64
+	_       *byte  // Control
+	_       uint64 // Control len
+	Flags   int32
+	_       [4]byte // padding
+}
+
+// appendNameKey appends the key for the host in the raw linux socket address.
+// It must match the keys made from the addresses decodeName returns.
+func appendNameKey(buf []byte, name []byte) []byte {
+	if len(name) < 2 {
+		return buf
+	}
+
+	switch binary.LittleEndian.Uint16(name[0:2]) {
+	case syscall.AF_INET:
+		if len(name) < syscall.SizeofSockaddrInet4 {
+			return buf
+		}
+		buf = append(buf, 'i', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff)
+		return append(buf, name[4:8]...)
+
+	case syscall.AF_INET6:
+		if len(name) < syscall.SizeofSockaddrInet6 {
+			return buf
+		}
+		return append(append(buf, 'i'), name[8:24]...)
+
+	case syscall.AF_UNIX:
+		path := name[2:]
+		for i, b := range path {
+			if b == 0 {
+				path = path[:i]
+				break
+			}
+		}
+		return append(append(buf, 'u'), path...)
+
+	default:
+		return buf
+	}
+}
+
+// decodeName converts a raw linux socket address into a net.Addr.
+func decodeName(name []byte) net.Addr {
+	if len(name) < 2 {
+		return nil
+	}
+
+	switch binary.LittleEndian.Uint16(name[0:2]) {
+	case syscall.AF_INET:
+		if len(name) < syscall.SizeofSockaddrInet4 {
+			return nil
+		}
+		return &net.UDPAddr{
+			IP:   append(net.IP(nil), name[4:8]...),
+			Port: int(binary.BigEndian.Uint16(name[2:4])),
+		}
+
+	case syscall.AF_INET6:
+		if len(name) < syscall.SizeofSockaddrInet6 {
+			return nil
+		}
+		addr := &net.UDPAddr{
+			IP:   append(net.IP(nil), name[8:24]...),
+			Port: int(binary.BigEndian.Uint16(name[2:4])),
+		}
+		if scope := binary.LittleEndian.Uint32(name[24:28]); scope != 0 {
+			if ifi, err := net.InterfaceByIndex(int(scope)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+
+	case syscall.AF_UNIX:
+		// unnamed sockets have no path, which is still a known source.
+		path := name[2:]
+		for i, b := range path {
+			if b == 0 {
+				path = path[:i]
+				break
+			}
+		}
+		return &net.UnixAddr{Name: string(path), Net: "unixgram"}
+
+	default:
+		return nil
+	}
 }
 
 // recvmmsg runs the recvmmsg syscall on the fd with the provided msg headers.
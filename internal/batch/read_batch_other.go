@@ -4,6 +4,7 @@
 package batch
 
 import (
+	"net"
 	"syscall"
 )
 
@@ -15,17 +16,28 @@ func Read(sc syscall.RawConn, msgs []*Message) (int, error) {
 	if len(msgs) == 0 {
 		return 0, nil
 	}
+	msgs[0].SetSource(nil)
+	msgs[0].truncated = false
 
 	var n int
+	var readErr error
 	err := sc.Read(func(fd uintptr) bool {
-		var err error
-		n, err = syscall.Read(int(fd), msgs[0].buf[:])
-		return err != syscall.EAGAIN
+		n, readErr = syscall.Read(int(fd), msgs[0].buf[:])
+		return readErr != syscall.EAGAIN
 	})
 	if err != nil {
 		return 0, err
 	}
+	if readErr != nil {
+		return 0, readErr
+	}
 
 	msgs[0].Data = msgs[0].buf[:n]
 	return 1, nil
 }
+
+// decodeName is unused because the sender is not recorded on this platform.
+func decodeName(name []byte) net.Addr { return nil }
+
+// appendNameKey is unused because the sender is not recorded on this platform.
+func appendNameKey(buf []byte, name []byte) []byte { return buf }
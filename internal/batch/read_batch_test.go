@@ -1,7 +1,12 @@
 package batch
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -31,29 +36,201 @@ func TestRead(t *testing.T) {
 	listnerRawConn, err := listenerConn.SyscallConn()
 	assertNoError(t, err)
 
-	// give it a second or ten
-	chm := make(chan *Message)
-	time.AfterFunc(10*time.Second, func() { close(chm) })
+	msg := testRead(t, listnerRawConn, writerConn)
+
+	// the sender is only known on some platforms.
+	if runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
+		source := msg.Source()
+		if source == nil || source.String() != writerConn.LocalAddr().String() {
+			t.Fatalf("source: %v != %v", source, writerConn.LocalAddr())
+		}
+
+		// the key from the raw name must match the key from the address.
+		var decoded Message
+		decoded.SetSource(source)
+		if got, exp := string(msg.AppendSourceKey(nil)), string(decoded.AppendSourceKey(nil)); got != exp {
+			t.Fatalf("key: %x != %x", got, exp)
+		}
+	}
+}
+
+func TestRead_Unixgram(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix datagram sockets are not supported")
+	}
+
+	dir, err := ioutil.TempDir("", "batch")
+	assertNoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the same ceremony, but with a unix datagram socket.
+	addr := &net.UnixAddr{Name: filepath.Join(dir, "sock"), Net: "unixgram"}
+	listenerConn, err := net.ListenUnixgram("unixgram", addr)
+	assertNoError(t, err)
+	defer listenerConn.Close()
+
+	writerConn, err := net.DialUnix("unixgram", nil, addr)
+	assertNoError(t, err)
+	defer writerConn.Close()
+
+	listnerRawConn, err := listenerConn.SyscallConn()
+	assertNoError(t, err)
+
+	testRead(t, listnerRawConn, writerConn)
+}
+
+// testRead checks that a packet written to the writer can be read from the
+// raw conn, and returns the Message it was read into.
+func testRead(t *testing.T, rc syscall.RawConn, writer net.Conn) *Message {
+	t.Helper()
 
 	// try to read it
+	type result struct {
+		msg *Message
+		err error
+	}
+	results := make(chan result, 1)
 	go func() {
 		msg := new(Message)
-		n, err := Read(listnerRawConn, []*Message{msg})
-		if n != 1 || err != nil {
-			t.Fatalf("read error: %v %v", n, err)
+		n, err := Read(rc, []*Message{msg})
+		if err == nil && n != 1 {
+			msg = nil
 		}
-		chm <- msg
+		results <- result{msg: msg, err: err}
 	}()
 
 	// write it
-	writerConn.Write([]byte("hello"))
-	msg := <-chm
+	_, err := writer.Write([]byte("hello"))
+	assertNoError(t, err)
+
+	// give it a second or ten
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
 
 	// check it
-	if msg == nil {
+	assertNoError(t, res.err)
+	if res.msg == nil {
 		t.Fatal("nil message")
 	}
-	if string(msg.Data) != "hello" {
-		t.Fatalf("msg: %+v", msg)
+	if string(res.msg.Data) != "hello" {
+		t.Fatalf("msg: %+v", res.msg)
+	}
+	return res.msg
+}
+
+func TestMessage_SetSource(t *testing.T) {
+	var msg Message
+	if msg.Source() != nil {
+		t.Fatal("expected no source")
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}
+	msg.SetSource(addr)
+	if msg.Source() != addr {
+		t.Fatalf("source: %v", msg.Source())
+	}
+
+	msg.SetSource(nil)
+	if msg.Source() != nil {
+		t.Fatal("expected no source")
+	}
+}
+
+func TestRead_Truncated(t *testing.T) {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("truncation is not reported on this platform")
+	}
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assertNoError(t, err)
+	defer listener.Close()
+
+	writerConn, err := net.Dial("udp", listener.LocalAddr().String())
+	assertNoError(t, err)
+	defer writerConn.Close()
+
+	rc, err := listener.(*net.UDPConn).SyscallConn()
+	assertNoError(t, err)
+
+	// the packet is larger than the buffer, so only the start is read.
+	msg := new(Message)
+	msg.SetTruncated(true)
+	_, err = writerConn.Write(make([]byte, 2000))
+	assertNoError(t, err)
+	n, err := Read(rc, []*Message{msg})
+	assertNoError(t, err)
+	if n != 1 || len(msg.Data) != len(msg.Buffer()) || !msg.Truncated() {
+		t.Fatalf("n: %d, len: %d, truncated: %v", n, len(msg.Data), msg.Truncated())
+	}
+
+	// the next packet fits, and the flag is cleared.
+	_, err = writerConn.Write([]byte("hello"))
+	assertNoError(t, err)
+	n, err = Read(rc, []*Message{msg})
+	assertNoError(t, err)
+	if n != 1 || string(msg.Data) != "hello" || msg.Truncated() {
+		t.Fatalf("n: %d, data: %q, truncated: %v", n, msg.Data, msg.Truncated())
+	}
+}
+
+func TestMessage_AppendSourceKey(t *testing.T) {
+	key := func(addr net.Addr) string {
+		var msg Message
+		msg.SetSource(addr)
+		return string(msg.AppendSourceKey(nil))
+	}
+
+	if key(nil) != "" {
+		t.Fatal("expected no key")
+	}
+
+	// ports and the way the ip is stored do not matter.
+	a := key(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5})
+	b := key(&net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 6})
+	if a == "" || a != b {
+		t.Fatalf("keys: %x != %x", a, b)
+	}
+
+	if c := key(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 5), Port: 5}); a == c {
+		t.Fatalf("keys: %x == %x", a, c)
+	}
+	if c := key(&net.UnixAddr{Name: "/tmp/sock", Net: "unixgram"}); c != "u/tmp/sock" {
+		t.Fatalf("key: %q", c)
+	}
+}
+
+func TestRead_Errno(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("connection refused is only reported for udp reads on linux")
+	}
+
+	// find a port that nothing is listening on.
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assertNoError(t, err)
+	addr := closed.LocalAddr().(*net.UDPAddr)
+	assertNoError(t, closed.Close())
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	assertNoError(t, err)
+	defer conn.Close()
+
+	// the icmp error from this write is reported by the next read.
+	_, err = conn.Write([]byte("hello"))
+	assertNoError(t, err)
+
+	rc, err := conn.SyscallConn()
+	assertNoError(t, err)
+
+	assertNoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+	n, err := Read(rc, []*Message{new(Message), new(Message)})
+	if err != syscall.ECONNREFUSED {
+		t.Fatalf("expected connection refused: %d %v", n, err)
+	}
+	if n != 0 {
+		t.Fatalf("expected no messages: %d", n)
 	}
 }
@@ -1,6 +1,7 @@
 package batch
 
 import (
+	"net"
 	"syscall"
 )
 
@@ -14,6 +15,8 @@ func Read(sc syscall.RawConn, msgs []*Message) (int, error) {
 	if len(msgs) == 0 {
 		return 0, nil
 	}
+	msgs[0].SetSource(nil)
+	msgs[0].truncated = false
 
 	//TODO: currently only reads one message at a time
 	var recverr error
@@ -30,6 +33,12 @@ func Read(sc syscall.RawConn, msgs []*Message) (int, error) {
 		buf.Len = uint32(len(msg.buf))
 
 		recverr = syscall.WSARecv(syscall.Handle(fd), &buf, 1, &read, &flags, nil, nil)
+		if recverr == e_WSAEMSGSIZE {
+			// the buffer was filled with the start of a larger datagram.
+			msg.truncated = true
+			recverr = nil
+			read = buf.Len
+		}
 		msg.Data = msg.buf[:read]
 		if recverr != nil || read == 0 {
 			return true
@@ -48,3 +57,9 @@ func Read(sc syscall.RawConn, msgs []*Message) (int, error) {
 
 	return messageCount, nil
 }
+
+// decodeName is unused because the sender is not recorded on this platform.
+func decodeName(name []byte) net.Addr { return nil }
+
+// appendNameKey is unused because the sender is not recorded on this platform.
+func appendNameKey(buf []byte, name []byte) []byte { return buf }
@@ -0,0 +1,56 @@
+package packet
+
+import (
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/zeebo/errs"
+)
+
+// UnixgramScheme is the prefix of addresses that are unix datagram sockets.
+// Any other address is a udp host:port.
+const UnixgramScheme = "unixgram://"
+
+// Dial connects to the address to send packets.
+func Dial(address string) (net.Conn, error) {
+	if strings.HasPrefix(address, UnixgramScheme) {
+		addr := &net.UnixAddr{Name: address[len(UnixgramScheme):], Net: "unixgram"}
+		return net.DialUnix("unixgram", nil, addr)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, addr)
+}
+
+// Listen listens for packets on the address. It returns the connection, which
+// must be closed, along with its RawConn to read from with a Dispatcher.
+func Listen(address string) (net.PacketConn, syscall.RawConn, error) {
+	var pc net.PacketConn
+	var err error
+	if strings.HasPrefix(address, UnixgramScheme) {
+		pc, err = net.ListenPacket("unixgram", address[len(UnixgramScheme):])
+	} else {
+		pc, err = net.ListenPacket("udp", address)
+	}
+	if err != nil {
+		return nil, nil, errs.Wrap(err)
+	}
+
+	sc, ok := pc.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	})
+	if !ok {
+		_ = pc.Close()
+		return nil, nil, errs.New("unsupported connection type: %T", pc)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		_ = pc.Close()
+		return nil, nil, errs.Wrap(err)
+	}
+	return pc, rc, nil
+}
@@ -0,0 +1,88 @@
+// package packet decodes whole admproto packets and opens the sockets they
+// are sent over.
+package packet
+
+import (
+	"github.com/zeebo/admission/v3/admproto"
+)
+
+// Header is a key/value pair from the start of a packet.
+type Header = admproto.Header
+
+// Point is a single decoded point.
+type Point struct {
+	Key          string
+	Labels       []admproto.Label
+	Kind         admproto.Kind
+	Value        float64
+	Delta        bool
+	Distribution *admproto.Distribution
+}
+
+// Packet is a fully decoded admproto packet.
+type Packet struct {
+	Application string
+	InstanceID  []byte
+	Headers     []Header
+	Options     admproto.Options
+	Frame       admproto.Frame
+	Generation  uint64
+	Points      []Point
+}
+
+// Decode verifies the checksum on the datagram and decodes the packet in it.
+// The returned Packet does not reference the datagram.
+func Decode(datagram []byte) (*Packet, error) {
+	data, err := admproto.CheckChecksum(datagram)
+	if err != nil {
+		return nil, err
+	}
+
+	var r admproto.Reader
+	data, application, instance_id, num_headers, err := r.Begin(data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Packet{
+		Application: string(application),
+		InstanceID:  append([]byte(nil), instance_id...),
+	}
+	p.Options = r.Options()
+	p.Frame, p.Generation = r.Frame()
+
+	for i := 0; i < num_headers; i++ {
+		var key, value []byte
+		data, key, value, err = r.NextHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		p.Headers = append(p.Headers, Header{Key: string(key), Value: string(value)})
+	}
+
+	for len(data) > 0 {
+		var key []byte
+		var value float64
+		data, key, value, err = r.Next(data)
+		if err != nil {
+			return nil, err
+		}
+
+		point := Point{
+			Key:    string(key),
+			Labels: append([]admproto.Label(nil), r.Labels()...),
+			Kind:   r.Kind(),
+			Value:  value,
+			Delta:  r.Delta(),
+		}
+		if point.Kind == admproto.DistributionKind {
+			dist := *r.Distribution()
+			dist.Positive = append([]admproto.Bucket(nil), dist.Positive...)
+			dist.Negative = append([]admproto.Bucket(nil), dist.Negative...)
+			point.Distribution = &dist
+		}
+		p.Points = append(p.Points, point)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,128 @@
+package admission
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/zeebo/admission/v3/admproto"
+)
+
+// DropReason is why the Dispatcher dropped a Message instead of passing it to
+// the Handler.
+type DropReason int
+
+const (
+	// DropOverloaded means too many calls to the Handler were in flight.
+	DropOverloaded DropReason = iota
+
+	// DropSourceLimit means the host that sent the Message went over the
+	// SourceLimit.
+	DropSourceLimit
+
+	// DropInstanceLimit means the application and instance id in the Message
+	// went over the InstanceLimit.
+	DropInstanceLimit
+
+	// DropTruncated means the packet did not fit in the Message.
+	DropTruncated
+
+	// DropInvalidChecksum means the packet failed checksum verification.
+	DropInvalidChecksum
+
+	// DropShutdown means the Message was read after the context passed to Run
+	// was done.
+	DropShutdown
+
+	// numDropReasons is the number of DropReasons.
+	numDropReasons
+)
+
+// String returns a short name for the reason.
+func (r DropReason) String() string {
+	switch r {
+	case DropOverloaded:
+		return "overloaded"
+	case DropSourceLimit:
+		return "source_limit"
+	case DropInstanceLimit:
+		return "instance_limit"
+	case DropTruncated:
+		return "truncated"
+	case DropInvalidChecksum:
+		return "invalid_checksum"
+	case DropShutdown:
+		return "shutdown"
+	default:
+		return "unknown"
+	}
+}
+
+// Limit is a token bucket limit on the rate of Messages. The zero value is no
+// limit.
+type Limit struct {
+	// Rate is the number of Messages allowed per second. If zero, Messages
+	// are not limited.
+	Rate float64
+
+	// Burst is the number of Messages allowed at once after being idle. Zero
+	// is one.
+	Burst int
+}
+
+// limiter returns a rateLimiter enforcing the limit, or nil if there is none.
+func (l Limit) limiter() *rateLimiter {
+	if l.Rate <= 0 {
+		return nil
+	}
+	return newRateLimiter(l.Rate, l.Burst)
+}
+
+// limits enforces the limits of a Dispatcher. Either limiter may be nil.
+type limits struct {
+	source   *rateLimiter
+	instance *rateLimiter
+}
+
+// check returns the reason the Message should be dropped and false if it is
+// over a limit, using up its share of the limits otherwise.
+func (l limits) check(m *Message, now time.Time) (DropReason, bool) {
+	var key [256]byte
+	if l.source != nil && !l.source.allow(m.AppendSourceKey(key[:0]), now) {
+		return DropSourceLimit, false
+	}
+	if l.instance != nil && !l.instance.allow(appendInstanceKey(key[:0], m.Data), now) {
+		if l.source != nil {
+			l.source.refund(m.AppendSourceKey(key[:0]))
+		}
+		return DropInstanceLimit, false
+	}
+	return 0, true
+}
+
+// refund gives back the share of the limits used by a Message that passed
+// check but was dropped anyway, so that senders are only limited by what is
+// handled.
+func (l limits) refund(m *Message) {
+	var key [256]byte
+	if l.source != nil {
+		l.source.refund(m.AppendSourceKey(key[:0]))
+	}
+	if l.instance != nil {
+		l.instance.refund(appendInstanceKey(key[:0], m.Data))
+	}
+}
+
+// appendInstanceKey appends a key for the application and instance id in the
+// packet. Packets that cannot be parsed all get the same, empty, key.
+func appendInstanceKey(buf []byte, data []byte) []byte {
+	var r admproto.Reader
+	_, application, instance_id, _, err := r.Begin(data)
+	if err != nil {
+		return buf
+	}
+
+	var scratch [binary.MaxVarintLen64]byte
+	buf = append(buf, scratch[:binary.PutUvarint(scratch[:], uint64(len(application)))]...)
+	buf = append(buf, application...)
+	return append(buf, instance_id...)
+}
@@ -0,0 +1,179 @@
+package admission
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/admtest"
+	"github.com/zeebo/assert"
+)
+
+// instancePacket returns a packet from the application and instance id with
+// the extra data as the only point.
+func instancePacket(t *testing.T, application, instance_id, data string) []byte {
+	w := admproto.NewWriterWith(admproto.Options{})
+	buf, err := w.Begin(nil, application, []byte(instance_id), 0)
+	assert.NoError(t, err)
+	buf, err = w.Append(buf, data, 1)
+	assert.NoError(t, err)
+	return admproto.AddChecksum(buf)
+}
+
+// dropRecorder counts the reasons passed to the Dropped hook.
+type dropRecorder struct {
+	mu      sync.Mutex
+	reasons map[DropReason]int
+}
+
+func (r *dropRecorder) dropped(ctx context.Context, reason DropReason, m *Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reasons == nil {
+		r.reasons = make(map[DropReason]int)
+	}
+	r.reasons[reason]++
+}
+
+func (r *dropRecorder) count(reason DropReason) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reasons[reason]
+}
+
+func TestDispatcher_SourceLimit(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+	stats := new(Stats)
+	drops := new(dropRecorder)
+	var dropped int64
+
+	d := Dispatcher{
+		Handler:     handler,
+		Source:      conn,
+		SourceLimit: Limit{Rate: 1e-6, Burst: 2},
+		Stats:       stats,
+	}
+	d.Hooks.Dropped = drops.dropped
+	d.Hooks.DroppedMessage = func(ctx context.Context) { atomic.AddInt64(&dropped, 1) }
+
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1}
+
+	conn.SendFrom(a, []byte("a1"))
+	conn.SendFrom(a, []byte("a2"))
+	conn.SendFrom(a, []byte("a3"))
+	conn.SendFrom(b, []byte("b1"))
+	assert.NoError(t, conn.Close())
+
+	assert.Error(t, d.Run(waitContext(t)))
+	assert.NoError(t, handler.Wait(waitContext(t), 3))
+
+	assert.DeepEqual(t, sortedData(handler), []string{"a1", "a2", "b1"})
+	assert.Equal(t, drops.count(DropSourceLimit), 1)
+	assert.Equal(t, drops.count(DropOverloaded), 0)
+	assert.Equal(t, atomic.LoadInt64(&dropped), int64(1))
+
+	snap := stats.Snapshot()
+	assert.Equal(t, snap.Dropped, int64(1))
+	assert.Equal(t, snap.Drops[DropSourceLimit], int64(1))
+}
+
+func TestDispatcher_InstanceLimit(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+	drops := new(dropRecorder)
+
+	d := Dispatcher{
+		Handler:       handler,
+		Source:        conn,
+		InstanceLimit: Limit{Rate: 1e-6, Burst: 1},
+	}
+	d.Hooks.Dropped = drops.dropped
+
+	// the same instance id in different applications is limited separately,
+	// and packets that cannot be parsed share a limit.
+	conn.Send(instancePacket(t, "app", "inst", "a1"))
+	conn.Send(instancePacket(t, "app", "inst", "a2"))
+	conn.Send(instancePacket(t, "other", "inst", "b1"))
+	conn.Send(instancePacket(t, "app", "other", "c1"))
+	conn.Send([]byte{0xff})
+	conn.Send([]byte{0xff})
+	assert.NoError(t, conn.Close())
+
+	assert.Error(t, d.Run(waitContext(t)))
+	assert.NoError(t, handler.Wait(waitContext(t), 4))
+
+	assert.Equal(t, len(handler.Data()), 4)
+	assert.Equal(t, drops.count(DropInstanceLimit), 2)
+}
+
+func TestDispatcher_LimitOverloaded(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := &admtest.Handler{Gate: make(chan struct{})}
+	drops := new(dropRecorder)
+	dropped := make(chan struct{}, 3)
+
+	d := Dispatcher{
+		Handler:       handler,
+		Source:        conn,
+		InFlight:      1,
+		SourceLimit:   Limit{Rate: 1e-6, Burst: 2},
+		InstanceLimit: Limit{Rate: 1e-6, Burst: 2},
+	}
+	d.Hooks.Dropped = func(ctx context.Context, reason DropReason, m *Message) {
+		drops.dropped(ctx, reason, m)
+		dropped <- struct{}{}
+	}
+
+	// the first message is stuck in the handler, so the rest are dropped
+	// because of it and not because they used up the limits.
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	for _, data := range []string{"a1", "a2", "a3", "a4"} {
+		conn.SendFrom(a, instancePacket(t, "app", "inst", data))
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- d.Run(waitContext(t)) }()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-dropped:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for drops")
+		}
+	}
+	close(handler.Gate)
+	assert.NoError(t, handler.Wait(waitContext(t), 1))
+
+	assert.Equal(t, drops.count(DropOverloaded), 3)
+	assert.Equal(t, drops.count(DropSourceLimit), 0)
+	assert.Equal(t, drops.count(DropInstanceLimit), 0)
+
+	assert.NoError(t, conn.Close())
+	assert.Error(t, <-errc)
+}
+
+func TestAppendInstanceKey(t *testing.T) {
+	key := func(application, instance_id string) string {
+		return string(appendInstanceKey(nil, instancePacket(t, application, instance_id, "x")))
+	}
+
+	assert.Equal(t, key("app", "inst"), key("app", "inst"))
+	assert.That(t, key("app", "inst") != key("appi", "nst"))
+	assert.That(t, key("", "") != "")
+	assert.Equal(t, string(appendInstanceKey(nil, []byte{0xff})), "")
+}
+
+func TestDropReason_String(t *testing.T) {
+	assert.Equal(t, DropOverloaded.String(), "overloaded")
+	assert.Equal(t, DropSourceLimit.String(), "source_limit")
+	assert.Equal(t, DropInstanceLimit.String(), "instance_limit")
+	assert.Equal(t, DropTruncated.String(), "truncated")
+	assert.Equal(t, DropInvalidChecksum.String(), "invalid_checksum")
+	assert.Equal(t, DropShutdown.String(), "shutdown")
+	assert.Equal(t, numDropReasons.String(), "unknown")
+}
@@ -0,0 +1,94 @@
+package admission
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeebo/admission/v3/admproto"
+)
+
+// HandlerFunc is a function that implements Handler.
+type HandlerFunc func(ctx context.Context, m *Message)
+
+// Handle implements Handler by calling the function.
+func (f HandlerFunc) Handle(ctx context.Context, m *Message) { f(ctx, m) }
+
+// Middleware wraps a Handler, returning a Handler that does something before
+// or after passing Messages on to it, or that does not pass them on at all.
+type Middleware func(next Handler) Handler
+
+// Chain returns a Handler that passes Messages through the middlewares in
+// order before they reach the Handler, so the first middleware sees every
+// Message first.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// VerifyChecksum returns a Middleware that only passes on Messages with a
+// valid checksum. The Data passed on still has the checksum on the end. If
+// invalid is not nil, it is called with every Message that is not passed on.
+func VerifyChecksum(invalid func(ctx context.Context, m *Message)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, m *Message) {
+			if _, err := admproto.CheckChecksum(m.Data); err != nil {
+				if invalid != nil {
+					invalid(ctx, m)
+				}
+				return
+			}
+			next.Handle(ctx, m)
+		})
+	}
+}
+
+// RateLimit returns a Middleware that passes on up to rate Messages per second
+// from every sending host, allowing bursts of up to burst Messages. Messages
+// with no known source share a single limit. If limited is not nil, it is
+// called with every Message that is not passed on.
+func RateLimit(rate float64, burst int, limited func(ctx context.Context, m *Message)) Middleware {
+	return func(next Handler) Handler {
+		limiter := newRateLimiter(rate, burst)
+		return HandlerFunc(func(ctx context.Context, m *Message) {
+			var key [64]byte
+			if !limiter.allow(m.AppendSourceKey(key[:0]), time.Now()) {
+				if limited != nil {
+					limited(ctx, m)
+				}
+				return
+			}
+			next.Handle(ctx, m)
+		})
+	}
+}
+
+// Sample returns a Middleware that passes on the fraction of the Messages,
+// where 0 <= fraction <= 1. The Messages passed on are spread evenly rather
+// than chosen at random.
+func Sample(fraction float64) Middleware {
+	return func(next Handler) Handler {
+		var count uint64
+		return HandlerFunc(func(ctx context.Context, m *Message) {
+			n := atomic.AddUint64(&count, 1)
+			if uint64(float64(n)*fraction) == uint64(float64(n-1)*fraction) {
+				return
+			}
+			next.Handle(ctx, m)
+		})
+	}
+}
+
+// Latency returns a Middleware that calls observe with how long the rest of
+// the chain took to handle every Message.
+func Latency(observe func(ctx context.Context, m *Message, d time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, m *Message) {
+			start := time.Now()
+			next.Handle(ctx, m)
+			observe(ctx, m, time.Since(start))
+		})
+	}
+}
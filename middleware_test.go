@@ -0,0 +1,148 @@
+package admission
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/assert"
+)
+
+// handleAll passes a message with each of the datas to the handler.
+func handleAll(h Handler, datas ...string) {
+	for _, data := range datas {
+		m := new(Message)
+		m.Data = append(m.Buffer()[:0], data...)
+		h.Handle(context.Background(), m)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, m *Message) {
+				order = append(order, name)
+				next.Handle(ctx, m)
+			})
+		}
+	}
+
+	h := newCollectHandler()
+	handleAll(Chain(h, mark("a"), mark("b"), mark("c")), "x")
+
+	assert.DeepEqual(t, order, []string{"a", "b", "c"})
+	assert.DeepEqual(t, h.collected(), []string{"x"})
+
+	// no middlewares is just the handler.
+	assert.Equal(t, Chain(h), h)
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	valid := string(admproto.AddChecksum([]byte("valid")))
+
+	var invalid []string
+	h := newCollectHandler()
+	handleAll(Chain(h, VerifyChecksum(func(ctx context.Context, m *Message) {
+		invalid = append(invalid, string(m.Data))
+	})), valid, "invalid", "")
+
+	assert.DeepEqual(t, h.collected(), []string{valid})
+	assert.DeepEqual(t, invalid, []string{"invalid", ""})
+}
+
+func TestRateLimit(t *testing.T) {
+	var limited int
+	h := newCollectHandler()
+	chain := Chain(h, RateLimit(1e-6, 2, func(ctx context.Context, m *Message) {
+		limited++
+	}))
+
+	send := func(source net.Addr, data string) {
+		m := new(Message)
+		m.Data = append(m.Buffer()[:0], data...)
+		m.SetSource(source)
+		chain.Handle(context.Background(), m)
+	}
+
+	a1 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	a2 := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1}
+
+	// different ports on the same host share a limit.
+	send(a1, "a1")
+	send(a2, "a2")
+	send(a1, "a3")
+	send(b, "b1")
+	send(nil, "n1")
+	send(nil, "n2")
+	send(nil, "n3")
+
+	assert.DeepEqual(t, h.collected(), []string{"a1", "a2", "b1", "n1", "n2"})
+	assert.Equal(t, limited, 2)
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := newRateLimiter(10, 1)
+	key := []byte("key")
+
+	assert.That(t, r.allow(key, now))
+	assert.That(t, !r.allow(key, now))
+	assert.That(t, !r.allow(key, now.Add(50*time.Millisecond)))
+	assert.That(t, r.allow(key, now.Add(100*time.Millisecond)))
+
+	// refunded tokens can be used again, but never go over the burst.
+	r.refund(key)
+	r.refund(key)
+	assert.That(t, r.allow(key, now.Add(100*time.Millisecond)))
+	assert.That(t, !r.allow(key, now.Add(100*time.Millisecond)))
+
+	// once full, the least recently used bucket is forgotten for a new key.
+	other := []byte("other")
+	assert.That(t, r.allow(other, now))
+	for i := 0; i < rateLimiterSize-2; i++ {
+		r.allow([]byte{byte(i), byte(i >> 8)}, now)
+	}
+	assert.Equal(t, len(r.buckets), rateLimiterSize)
+	assert.That(t, !r.allow(other, now))
+
+	// the first key is the least recently used, so it is the one evicted.
+	r.allow([]byte("new"), now)
+	assert.Equal(t, len(r.buckets), rateLimiterSize)
+	assert.Equal(t, r.lru.Len(), rateLimiterSize)
+	_, ok := r.buckets[string(key)]
+	assert.That(t, !ok)
+	assert.That(t, !r.allow(other, now))
+}
+
+func TestSample(t *testing.T) {
+	h := newCollectHandler()
+	handleAll(Chain(h, Sample(0.25)), "1", "2", "3", "4", "5", "6", "7", "8")
+	assert.DeepEqual(t, h.collected(), []string{"4", "8"})
+
+	h = newCollectHandler()
+	handleAll(Chain(h, Sample(0)), "1", "2")
+	assert.Equal(t, len(h.collected()), 0)
+
+	h = newCollectHandler()
+	handleAll(Chain(h, Sample(1)), "1", "2")
+	assert.DeepEqual(t, h.collected(), []string{"1", "2"})
+}
+
+func TestLatency(t *testing.T) {
+	var observed []time.Duration
+	slow := HandlerFunc(func(ctx context.Context, m *Message) {
+		time.Sleep(10 * time.Millisecond)
+	})
+
+	handleAll(Chain(slow, Latency(func(ctx context.Context, m *Message, d time.Duration) {
+		assert.Equal(t, string(m.Data), "x")
+		observed = append(observed, d)
+	})), "x")
+
+	assert.Equal(t, len(observed), 1)
+	assert.That(t, observed[0] >= 10*time.Millisecond)
+}
@@ -0,0 +1,78 @@
+package admission
+
+import "context"
+
+// DefaultWorkers is the number of goroutines calling the Handler when the
+// Dispatcher preserves the order of Messages.
+const DefaultWorkers = 16
+
+// Ordering controls if the Dispatcher preserves the order Messages from the
+// same sender arrived in when passing them to the Handler.
+type Ordering int
+
+const (
+	// Unordered passes every Message to the Handler in its own goroutine, so
+	// Messages may be handled in any order.
+	Unordered Ordering = iota
+
+	// OrderBySource passes Messages from the same sending host to the Handler
+	// one at a time in the order they arrived. Messages with no known sender
+	// are all handled in order with each other.
+	OrderBySource
+
+	// OrderByInstance passes Messages with the same application and instance
+	// id to the Handler one at a time in the order they arrived. Messages
+	// that cannot be parsed are all handled in order with each other.
+	OrderByInstance
+)
+
+// shard returns which of n workers should handle the message.
+func (o Ordering) shard(m *Message, n int) int {
+	var buf [256]byte
+	var key []byte
+	switch o {
+	case OrderBySource:
+		key = m.AppendSourceKey(buf[:0])
+	case OrderByInstance:
+		key = appendInstanceKey(buf[:0], m.Data)
+	}
+
+	// fnv-1a, inlined to avoid allocating a hash.Hash.
+	hash := uint64(14695981039346656037)
+	for _, b := range key {
+		hash ^= uint64(b)
+		hash *= 1099511628211
+	}
+	return int(hash % uint64(n))
+}
+
+// startWorkers starts the goroutines that handle messages in order and returns
+// the queues feeding them. A message must hold a slot in the semaphore before
+// it is queued, so the queues are large enough to never block. The workers
+// exit once the queues are closed and drained.
+func (d *Dispatcher) startWorkers(ctx context.Context, sem chan struct{}) []chan *Message {
+	workers := d.Workers
+	if workers == 0 {
+		workers = DefaultWorkers
+	}
+
+	queues := make([]chan *Message, workers)
+	for i := range queues {
+		queue := make(chan *Message, cap(sem))
+		queues[i] = queue
+
+		go func() {
+			for m := range queue {
+				d.handleMessage(ctx, sem, m)
+			}
+		}()
+	}
+	return queues
+}
+
+// closeQueues closes the queues so that the workers exit.
+func closeQueues(queues []chan *Message) {
+	for _, queue := range queues {
+		close(queue)
+	}
+}
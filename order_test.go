@@ -0,0 +1,154 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/admtest"
+	"github.com/zeebo/assert"
+)
+
+// orderHandler records the data of the messages from each sender, and sleeps
+// a little while handling them to encourage reordering. If parse is nil, the
+// sender is the data up to the first dash.
+type orderHandler struct {
+	parse func(data []byte) (sender, label string)
+
+	mu   sync.Mutex
+	seen map[string][]string
+	wg   sync.WaitGroup
+}
+
+func (o *orderHandler) Handle(ctx context.Context, m *Message) {
+	defer o.wg.Done()
+	time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+
+	data := string(m.Data)
+	sender := data[:strings.IndexByte(data, '-')]
+	if o.parse != nil {
+		sender, data = o.parse(m.Data)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.seen == nil {
+		o.seen = make(map[string][]string)
+	}
+	o.seen[sender] = append(o.seen[sender], data)
+}
+
+func TestDispatcher_OrderBySource(t *testing.T) {
+	const senders, packets = 4, 50
+
+	conn := admtest.NewConn()
+	handler := new(orderHandler)
+	handler.wg.Add(senders * packets)
+
+	// the packets from the senders are interleaved.
+	var expected [senders][]string
+	for i := 0; i < packets; i++ {
+		for s := 0; s < senders; s++ {
+			data := fmt.Sprintf("%d-%d", s, i)
+			expected[s] = append(expected[s], data)
+			conn.SendFrom(&net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(s)), Port: i}, []byte(data))
+		}
+	}
+
+	d := Dispatcher{Handler: handler, Source: conn, Ordering: OrderBySource, Workers: 2}
+	stop := runDispatcher(t, d, conn)
+	handler.wg.Wait()
+	assert.Error(t, stop())
+
+	for s := range expected {
+		assert.DeepEqual(t, handler.seen[fmt.Sprint(s)], expected[s])
+	}
+}
+
+func TestDispatcher_OrderByInstance(t *testing.T) {
+	const instances, packets = 4, 50
+
+	conn := admtest.NewConn()
+	handler := &orderHandler{parse: func(data []byte) (sender, label string) {
+		var r admproto.Reader
+		data, _, instance_id, _, err := r.Begin(data)
+		assert.NoError(t, err)
+		_, key, _, err := r.Next(data)
+		assert.NoError(t, err)
+		return string(instance_id), string(key)
+	}}
+	handler.wg.Add(instances * packets)
+
+	// one host sends for every instance.
+	source := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	var expected [instances][]string
+	for i := 0; i < packets; i++ {
+		for s := 0; s < instances; s++ {
+			label := fmt.Sprintf("%d-%d", s, i)
+			expected[s] = append(expected[s], label)
+			conn.SendFrom(source, instancePacket(t, "app", fmt.Sprint(s), label))
+		}
+	}
+
+	d := Dispatcher{Handler: handler, Source: conn, Ordering: OrderByInstance, Workers: 4}
+	stop := runDispatcher(t, d, conn)
+	handler.wg.Wait()
+	assert.Error(t, stop())
+
+	for s := range expected {
+		assert.DeepEqual(t, handler.seen[fmt.Sprint(s)], expected[s])
+	}
+}
+
+func TestDispatcher_OrderedParallel(t *testing.T) {
+	conn := admtest.NewConn()
+	blocked := make(chan struct{})
+	handled := make(chan string, 1)
+
+	// find two hosts that are handled by different workers.
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1}
+	for i := byte(2); ; i++ {
+		b.IP = net.IPv4(10, 0, 0, i)
+		ma, mb := new(Message), new(Message)
+		ma.SetSource(a)
+		mb.SetSource(b)
+		if OrderBySource.shard(ma, 2) != OrderBySource.shard(mb, 2) {
+			break
+		}
+	}
+
+	d := Dispatcher{
+		Handler: HandlerFunc(func(ctx context.Context, m *Message) {
+			if string(m.Data) == "a" {
+				<-blocked
+				return
+			}
+			handled <- string(m.Data)
+		}),
+		Source:   conn,
+		Ordering: OrderBySource,
+		Workers:  2,
+	}
+
+	// a blocked sender does not hold up the others.
+	conn.SendFrom(a, []byte("a"))
+	conn.SendFrom(b, []byte("b"))
+	stop := runDispatcher(t, d, conn)
+
+	select {
+	case data := <-handled:
+		assert.Equal(t, data, "b")
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	close(blocked)
+	assert.Error(t, stop())
+}
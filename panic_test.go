@@ -0,0 +1,80 @@
+package admission
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zeebo/admission/v3/admtest"
+	"github.com/zeebo/assert"
+)
+
+// panicHandler panics on messages with the data "boom" and passes the rest to
+// the next handler.
+type panicHandler struct {
+	next Handler
+}
+
+func (p panicHandler) Handle(ctx context.Context, m *Message) {
+	if string(m.Data) == "boom" {
+		panic("kaboom")
+	}
+	p.next.Handle(ctx, m)
+}
+
+// waitIdle waits until no calls to the Handler are in flight.
+func waitIdle(stats *Stats) {
+	for stats.Snapshot().InFlight != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatcher_RecoverPanics(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+	stats := new(Stats)
+
+	var mu sync.Mutex
+	var values []interface{}
+	var datas []string
+	panicked := make(chan struct{}, 2)
+
+	d := Dispatcher{
+		Handler:       panicHandler{next: handler},
+		Source:        conn,
+		InFlight:      1,
+		RecoverPanics: true,
+		Stats:         stats,
+	}
+	d.Hooks.HandlerPanic = func(ctx context.Context, value interface{}, data []byte) {
+		mu.Lock()
+		values = append(values, value)
+		datas = append(datas, string(data))
+		mu.Unlock()
+		panicked <- struct{}{}
+	}
+
+	// with only one slot, the panic must release it for the next message to
+	// be handled.
+	stop := runDispatcher(t, d, conn)
+	conn.Send([]byte("boom"))
+	<-panicked
+	waitIdle(stats)
+	conn.Send([]byte("a"))
+	assert.NoError(t, handler.Wait(waitContext(t), 1))
+	conn.Send([]byte("boom"))
+	<-panicked
+	waitIdle(stats)
+	conn.Send([]byte("b"))
+	assert.NoError(t, handler.Wait(waitContext(t), 2))
+	assert.Error(t, stop())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.DeepEqual(t, values, []interface{}{"kaboom", "kaboom"})
+	assert.DeepEqual(t, datas, []string{"boom", "boom"})
+	assert.DeepEqual(t, sortedData(handler), []string{"a", "b"})
+	assert.Equal(t, stats.Snapshot().Panics, int64(2))
+	assert.Equal(t, stats.Snapshot().Dropped, int64(0))
+}
@@ -0,0 +1,102 @@
+package admission
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// rateLimiterSize is the most buckets a rateLimiter holds. Once it is full,
+// the least recently used bucket is forgotten to make room for a new key.
+const rateLimiterSize = 4096
+
+// tokenBucket allows events at a rate with bursts of up to some size.
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the last refill, up to the burst.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rate
+		b.last = now
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// rateLimiter keeps a tokenBucket for up to rateLimiterSize recently used
+// keys. It is safe for concurrent use.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     list.List
+}
+
+// newRateLimiter returns a rateLimiter allowing rate events per second for
+// every key, with bursts of up to burst events. A burst less than one is one.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*list.Element),
+	}
+}
+
+// allow reports if an event for the key is allowed at the time, using up a
+// token if it is.
+func (r *rateLimiter) allow(key []byte, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.buckets[string(key)]
+	switch {
+	case ok:
+		r.lru.MoveToFront(el)
+
+	case r.lru.Len() >= rateLimiterSize:
+		// reuse the least recently used bucket for the new key.
+		el = r.lru.Back()
+		b := el.Value.(*tokenBucket)
+		delete(r.buckets, b.key)
+		*b = tokenBucket{key: string(key), tokens: r.burst, last: now}
+		r.buckets[b.key] = el
+		r.lru.MoveToFront(el)
+
+	default:
+		b := &tokenBucket{key: string(key), tokens: r.burst, last: now}
+		el = r.lru.PushFront(b)
+		r.buckets[b.key] = el
+	}
+
+	b := el.Value.(*tokenBucket)
+	b.refill(now, r.rate, r.burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refund gives back a token used by an event for the key that did not happen
+// after all, unless the bucket for the key has since been forgotten.
+func (r *rateLimiter) refund(key []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if el, ok := r.buckets[string(key)]; ok {
+		b := el.Value.(*tokenBucket)
+		if b.tokens++; b.tokens > r.burst {
+			b.tokens = r.burst
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+)
+
+const (
+	// minReadBackoff and maxReadBackoff bound the time the Dispatcher waits
+	// after a read error before reading again.
+	minReadBackoff = 10 * time.Millisecond
+	maxReadBackoff = time.Second
+)
+
+// ReadErrorAction is what the Dispatcher does after a read returns an error.
+type ReadErrorAction int
+
+const (
+	// ReadErrorStop causes Run to return the error.
+	ReadErrorStop ReadErrorAction = iota
+
+	// ReadErrorContinue causes the Dispatcher to read again immediately.
+	ReadErrorContinue
+
+	// ReadErrorBackoff causes the Dispatcher to wait before reading again,
+	// waiting twice as long after every consecutive error, up to a second.
+	ReadErrorBackoff
+)
+
+// ClassifyReadError is the default way the Dispatcher decides what to do
+// about a read error. Interrupted reads are retried immediately, errors that
+// sockets report because of earlier packets or a lack of memory, like
+// ECONNREFUSED from an ICMP message or ENOBUFS, are retried with backoff, and
+// everything else stops the Dispatcher.
+func ClassifyReadError(err error) ReadErrorAction {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return ReadErrorStop
+	}
+
+	switch errno {
+	case syscall.EINTR, syscall.EAGAIN:
+		return ReadErrorContinue
+	case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EHOSTUNREACH,
+		syscall.ENETUNREACH, syscall.ENOBUFS, syscall.ENOMEM:
+		return ReadErrorBackoff
+	default:
+		return ReadErrorStop
+	}
+}
+
+// readBackoff waits the current backoff, returning the next one and false if
+// the context was done first.
+func readBackoff(ctx context.Context, backoff time.Duration) (time.Duration, bool) {
+	if backoff < minReadBackoff {
+		backoff = minReadBackoff
+	}
+
+	t := time.NewTimer(backoff)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return backoff, false
+	}
+
+	if backoff *= 2; backoff > maxReadBackoff {
+		backoff = maxReadBackoff
+	}
+	return backoff, true
+}
@@ -0,0 +1,87 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/zeebo/admission/v3/admtest"
+	"github.com/zeebo/assert"
+	"github.com/zeebo/errs"
+)
+
+func TestClassifyReadError(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		action ReadErrorAction
+	}{
+		{syscall.EINTR, ReadErrorContinue},
+		{syscall.ENOBUFS, ReadErrorBackoff},
+		{syscall.ECONNREFUSED, ReadErrorBackoff},
+		{os.NewSyscallError("recvmmsg", syscall.ECONNREFUSED), ReadErrorBackoff},
+		{errs.Wrap(syscall.ENOMEM), ReadErrorBackoff},
+		{syscall.EBADF, ReadErrorStop},
+		{errors.New("other"), ReadErrorStop},
+	} {
+		assert.Equal(t, ClassifyReadError(test.err), test.action)
+	}
+}
+
+func TestDispatcher_TransientReadError(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+	stats := new(Stats)
+
+	conn.Fail(syscall.ENOBUFS)
+	conn.Fail(syscall.EINTR)
+	conn.Send([]byte("a"))
+	conn.Fail(syscall.EBADF)
+
+	err := Dispatcher{Handler: handler, Source: conn, Stats: stats}.Run(context.Background())
+	assert.Equal(t, errs.Unwrap(err), syscall.EBADF)
+
+	assert.NoError(t, handler.Wait(waitContext(t), 1))
+	assert.DeepEqual(t, sortedData(handler), []string{"a"})
+	assert.Equal(t, stats.Snapshot().ReadErrors, int64(3))
+}
+
+func TestDispatcher_OnReadError(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := new(admtest.Handler)
+	failure := errors.New("failure")
+
+	var seen []error
+	d := Dispatcher{Handler: handler, Source: conn}
+	d.OnReadError = func(ctx context.Context, err error) ReadErrorAction {
+		seen = append(seen, err)
+		if err == failure {
+			return ReadErrorContinue
+		}
+		return ReadErrorStop
+	}
+
+	conn.Fail(failure)
+	conn.Send([]byte("a"))
+	conn.Fail(syscall.ENOBUFS)
+
+	err := d.Run(context.Background())
+	assert.Equal(t, errs.Unwrap(err), syscall.ENOBUFS)
+	assert.DeepEqual(t, seen, []error{failure, syscall.ENOBUFS})
+	assert.NoError(t, handler.Wait(waitContext(t), 1))
+}
+
+func TestDispatcher_BackoffCancelled(t *testing.T) {
+	conn := admtest.NewConn()
+	conn.Fail(syscall.ENOBUFS)
+
+	// cancelling the context during a backoff stops the dispatcher.
+	ctx, cancel := context.WithCancel(context.Background())
+	d := Dispatcher{Handler: new(admtest.Handler), Source: conn}
+	d.OnReadError = func(ctx context.Context, err error) ReadErrorAction {
+		cancel()
+		return ReadErrorBackoff
+	}
+	assert.NoError(t, d.Run(ctx))
+}
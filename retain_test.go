@@ -0,0 +1,70 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zeebo/admission/v3/admtest"
+	"github.com/zeebo/assert"
+)
+
+func TestDispatcher_Retain(t *testing.T) {
+	const packets = 100
+
+	conn := admtest.NewConn()
+	kept := make(chan *Message, 3)
+
+	var (
+		mu      sync.Mutex
+		handled = make(map[*Message]bool)
+		wg      sync.WaitGroup
+	)
+
+	// the handler keeps some of the messages past the call to Handle, and
+	// remembers every other message it was passed.
+	d := Dispatcher{
+		Handler: HandlerFunc(func(ctx context.Context, m *Message) {
+			if strings.HasPrefix(string(m.Data), "keep") {
+				m.Retain()
+				kept <- m
+				return
+			}
+			mu.Lock()
+			handled[m] = true
+			mu.Unlock()
+			wg.Done()
+		}),
+		Source: conn,
+	}
+	stop := runDispatcher(t, d, conn)
+
+	conn.Send([]byte("keep-a"))
+	conn.Send([]byte("keep-b"))
+	conn.Send([]byte("keep-c"))
+
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, <-kept)
+	}
+
+	// more packets are read into messages from the pool after the kept ones
+	// have been handled.
+	wg.Add(packets)
+	for i := 0; i < packets; i++ {
+		conn.Send([]byte(fmt.Sprintf("other-%d", i)))
+	}
+	wg.Wait()
+	assert.Error(t, stop())
+
+	// the kept messages were never reused, so their data is untouched.
+	seen := make(map[string]bool)
+	for _, m := range msgs {
+		assert.That(t, !handled[m])
+		seen[string(m.Data)] = true
+		m.Release()
+	}
+	assert.DeepEqual(t, seen, map[string]bool{"keep-a": true, "keep-b": true, "keep-c": true})
+}
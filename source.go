@@ -0,0 +1,66 @@
+package admission
+
+import (
+	"io"
+	"syscall"
+
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/internal/batch"
+)
+
+// PacketSource is something a Dispatcher can read Messages from.
+type PacketSource interface {
+	// ReadMessages fills in the Data of up to len(msgs) Messages, blocking
+	// until at least one is read or there is an error, and returns how many
+	// were read. It returns io.EOF when there will never be more.
+	ReadMessages(msgs []*Message) (int, error)
+}
+
+// RawConnSource is a PacketSource that reads from a UDP or unix datagram
+// socket, reading as many packets per syscall as the platform allows.
+type RawConnSource struct {
+	Conn syscall.RawConn
+}
+
+// ReadMessages implements PacketSource.
+func (r RawConnSource) ReadMessages(msgs []*Message) (int, error) {
+	return batch.Read(r.Conn, msgs)
+}
+
+// FrameSource is a PacketSource that reads length prefixed frames, as written
+// by admproto.AppendFrame, from a stream like a TCP connection or a file. It
+// reads one frame at a time, so the Reader should be buffered. Frames too
+// large for a Message are skipped and reported as truncated.
+type FrameSource struct {
+	Reader io.Reader
+}
+
+// ReadMessages implements PacketSource.
+func (f FrameSource) ReadMessages(msgs []*Message) (n int, err error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	m := msgs[0]
+	m.Data, err = admproto.ReadFrame(f.Reader, m.Buffer()[:0])
+	if err == admproto.ErrFrameTooLarge {
+		m.Data = m.Buffer()[:0]
+		m.SetTruncated(true)
+	} else if err != nil {
+		return 0, err
+	}
+	m.SetSource(nil)
+	return 1, nil
+}
+
+// ReadMessages implements PacketSource by reading the next record in the
+// capture, so that a capture can be fed into a Dispatcher.
+func (c *CaptureReader) ReadMessages(msgs []*Message) (n int, err error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	if _, err := c.Next(msgs[0]); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
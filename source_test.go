@@ -0,0 +1,71 @@
+package admission
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/admission/v3/admtest"
+	"github.com/zeebo/assert"
+)
+
+func TestFrameSource(t *testing.T) {
+	var stream []byte
+	for _, packet := range []string{"a", "b", "c"} {
+		var err error
+		stream, err = admproto.AppendFrame(stream, admproto.AddChecksum([]byte(packet)))
+		assert.NoError(t, err)
+	}
+
+	// the dispatcher stops without error at the end of the stream.
+	handler := new(admtest.Handler)
+	source := FrameSource{Reader: bytes.NewReader(stream)}
+	assert.NoError(t, Dispatcher{Handler: handler, Source: source}.Run(context.Background()))
+	assert.NoError(t, handler.Wait(waitContext(t), 3))
+
+	var got []string
+	for _, data := range sortedData(handler) {
+		packet, err := admproto.CheckChecksum([]byte(data))
+		assert.NoError(t, err)
+		got = append(got, string(packet))
+	}
+	assert.DeepEqual(t, got, []string{"a", "b", "c"})
+
+	// a frame too large for a Message is dropped as truncated.
+	large := admproto.AddChecksum(bytes.Repeat([]byte("x"), 2*len(new(Message).Buffer())))
+	stream, err := admproto.AppendFrame(stream, large)
+	assert.NoError(t, err)
+
+	drops := new(dropRecorder)
+	d := Dispatcher{Handler: new(admtest.Handler), Source: FrameSource{Reader: bytes.NewReader(stream)}}
+	d.Hooks.Dropped = drops.dropped
+	assert.NoError(t, d.Run(context.Background()))
+	assert.Equal(t, drops.count(DropTruncated), 1)
+
+	// a stream cut off in the middle of a frame is an error.
+	source = FrameSource{Reader: bytes.NewReader(stream[:len(stream)-1])}
+	assert.Error(t, Dispatcher{Handler: new(admtest.Handler), Source: source}.Run(context.Background()))
+}
+
+func TestCaptureSource(t *testing.T) {
+	var capture bytes.Buffer
+	rec, err := NewRecorder(&capture, nil)
+	assert.NoError(t, err)
+	for _, data := range []string{"a", "b"} {
+		rec.Handle(context.Background(), &Message{Data: []byte(data)})
+	}
+	assert.NoError(t, rec.Flush())
+
+	cr, err := NewCaptureReader(&capture)
+	assert.NoError(t, err)
+
+	handler := new(admtest.Handler)
+	assert.NoError(t, Dispatcher{Handler: handler, Source: cr}.Run(context.Background()))
+	assert.NoError(t, handler.Wait(waitContext(t), 2))
+	assert.DeepEqual(t, sortedData(handler), []string{"a", "b"})
+}
+
+func TestDispatcher_NoSource(t *testing.T) {
+	assert.Error(t, Dispatcher{Handler: new(admtest.Handler)}.Run(context.Background()))
+}
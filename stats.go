@@ -0,0 +1,203 @@
+package admission
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets is the number of buckets in a LatencyHistogram.
+const LatencyBuckets = 32
+
+// LatencyHistogram counts durations in buckets that double in size. Bucket 0
+// holds durations under a microsecond, and bucket i holds durations of at
+// least 2^(i-1) and under 2^i microseconds. The last bucket holds everything
+// longer.
+type LatencyHistogram struct {
+	Buckets [LatencyBuckets]int64
+	Sum     time.Duration
+}
+
+// latencyBucket returns the bucket that the duration falls into.
+func latencyBucket(d time.Duration) int {
+	if d < 0 {
+		d = 0
+	}
+	idx := bits.Len64(uint64(d / time.Microsecond))
+	if idx >= LatencyBuckets {
+		idx = LatencyBuckets - 1
+	}
+	return idx
+}
+
+// Count returns the number of durations in the histogram.
+func (h *LatencyHistogram) Count() (count int64) {
+	for _, n := range h.Buckets {
+		count += n
+	}
+	return count
+}
+
+// Mean returns the average duration, or zero if there are none.
+func (h *LatencyHistogram) Mean() time.Duration {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(count)
+}
+
+// Quantile returns an upper bound on the duration at the quantile, where
+// 0 <= quantile <= 1. It returns zero if there are no durations.
+func (h *LatencyHistogram) Quantile(quantile float64) time.Duration {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+
+	rank := int64(quantile*float64(count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen int64
+	for idx, n := range h.Buckets {
+		if seen += n; seen >= rank {
+			return time.Duration(uint64(1)<<uint(idx)) * time.Microsecond
+		}
+	}
+	return time.Duration(uint64(1)<<(LatencyBuckets-1)) * time.Microsecond
+}
+
+// Stats collects statistics about a Dispatcher. The zero value is ready to
+// use, and it is safe for concurrent use. If multiple Dispatchers share one,
+// the statistics are combined.
+type Stats struct {
+	packets     int64
+	batches     int64
+	slots       int64
+	dropped     [numDropReasons]int64
+	readErrors  int64
+	inFlight    int64
+	maxInFlight int64
+	panics      int64
+	latency     [LatencyBuckets]int64
+	latencySum  int64
+}
+
+// StatsSnapshot is a copy of the statistics at a point in time.
+type StatsSnapshot struct {
+	// Packets is the number of Messages read.
+	Packets int64
+
+	// Batches is the number of successful reads.
+	Batches int64
+
+	// Slots is the number of Messages the reads could have filled.
+	Slots int64
+
+	// Dropped is the number of Messages dropped for any reason.
+	Dropped int64
+
+	// Drops is the number of Messages dropped for each reason, indexed by
+	// the DropReason.
+	Drops [numDropReasons]int64
+
+	// ReadErrors is the number of reads that returned an error.
+	ReadErrors int64
+
+	// InFlight is the number of calls to the Handler that have not returned.
+	InFlight int64
+
+	// MaxInFlight is the most calls to the Handler that have been in flight
+	// at once.
+	MaxInFlight int64
+
+	// Panics is the number of calls to the Handler that panicked and were
+	// recovered.
+	Panics int64
+
+	// HandlerLatency is how long calls to the Handler took.
+	HandlerLatency LatencyHistogram
+}
+
+// AverageBatch returns the average number of Messages read per batch.
+func (s StatsSnapshot) AverageBatch() float64 {
+	if s.Batches == 0 {
+		return 0
+	}
+	return float64(s.Packets) / float64(s.Batches)
+}
+
+// AverageFill returns the average fraction of the Messages in a batch that
+// were filled by a read.
+func (s StatsSnapshot) AverageFill() float64 {
+	if s.Slots == 0 {
+		return 0
+	}
+	return float64(s.Packets) / float64(s.Slots)
+}
+
+// Snapshot returns a copy of the current statistics. Because they are read
+// while they may be changing, they are not guaranteed to be consistent with
+// each other.
+func (s *Stats) Snapshot() (snap StatsSnapshot) {
+	snap.Packets = atomic.LoadInt64(&s.packets)
+	snap.Batches = atomic.LoadInt64(&s.batches)
+	snap.Slots = atomic.LoadInt64(&s.slots)
+	for i := range s.dropped {
+		snap.Drops[i] = atomic.LoadInt64(&s.dropped[i])
+		snap.Dropped += snap.Drops[i]
+	}
+	snap.ReadErrors = atomic.LoadInt64(&s.readErrors)
+	snap.InFlight = atomic.LoadInt64(&s.inFlight)
+	snap.MaxInFlight = atomic.LoadInt64(&s.maxInFlight)
+	snap.Panics = atomic.LoadInt64(&s.panics)
+	for i := range s.latency {
+		snap.HandlerLatency.Buckets[i] = atomic.LoadInt64(&s.latency[i])
+	}
+	snap.HandlerLatency.Sum = time.Duration(atomic.LoadInt64(&s.latencySum))
+	return snap
+}
+
+// read records a successful read of n Messages out of a possible slots.
+func (s *Stats) read(n, slots int) {
+	atomic.AddInt64(&s.packets, int64(n))
+	atomic.AddInt64(&s.batches, 1)
+	atomic.AddInt64(&s.slots, int64(slots))
+}
+
+// readError records a failed read.
+func (s *Stats) readError() {
+	atomic.AddInt64(&s.readErrors, 1)
+}
+
+// drop records a Message dropped for the reason.
+func (s *Stats) drop(reason DropReason) {
+	if reason >= 0 && reason < numDropReasons {
+		atomic.AddInt64(&s.dropped[reason], 1)
+	}
+}
+
+// start records a call to the Handler starting.
+func (s *Stats) start() {
+	in_flight := atomic.AddInt64(&s.inFlight, 1)
+	for {
+		max := atomic.LoadInt64(&s.maxInFlight)
+		if in_flight <= max || atomic.CompareAndSwapInt64(&s.maxInFlight, max, in_flight) {
+			return
+		}
+	}
+}
+
+// panicked records a recovered panic in the Handler.
+func (s *Stats) panicked() {
+	atomic.AddInt64(&s.panics, 1)
+}
+
+// done records a call to the Handler that took the duration finishing.
+func (s *Stats) done(d time.Duration) {
+	atomic.AddInt64(&s.inFlight, -1)
+	atomic.AddInt64(&s.latency[latencyBucket(d)], 1)
+	atomic.AddInt64(&s.latencySum, int64(d))
+}
@@ -0,0 +1,75 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zeebo/admission/v3/admtest"
+	"github.com/zeebo/assert"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h LatencyHistogram
+	assert.Equal(t, h.Quantile(0.5), time.Duration(0))
+	assert.Equal(t, h.Mean(), time.Duration(0))
+
+	for _, d := range []time.Duration{
+		500 * time.Nanosecond,
+		3 * time.Microsecond,
+		3 * time.Microsecond,
+		100 * time.Millisecond,
+	} {
+		h.Buckets[latencyBucket(d)]++
+		h.Sum += d
+	}
+
+	assert.Equal(t, h.Count(), int64(4))
+	assert.Equal(t, h.Quantile(0), time.Microsecond)
+	assert.Equal(t, h.Quantile(0.5), 4*time.Microsecond)
+	assert.Equal(t, h.Quantile(1), 131072*time.Microsecond)
+	assert.Equal(t, h.Mean(), (100*time.Millisecond+6500*time.Nanosecond)/4)
+
+	assert.Equal(t, latencyBucket(-time.Second), 0)
+	assert.Equal(t, latencyBucket(time.Duration(1<<62)), LatencyBuckets-1)
+}
+
+func TestDispatcher_Stats(t *testing.T) {
+	conn := admtest.NewConn()
+	handler := &admtest.Handler{Gate: make(chan struct{})}
+	stats := new(Stats)
+
+	conn.Send([]byte("a"))
+	conn.Send([]byte("b"))
+	conn.Send([]byte("c"))
+	conn.Fail(errors.New("failure"))
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Dispatcher{Handler: handler, Source: conn, InFlight: 1, Stats: stats}.Run(context.Background())
+	}()
+
+	ctx := waitContext(t)
+	assert.NoError(t, handler.WaitStarted(ctx, 1))
+	assert.Error(t, <-errc)
+
+	snap := stats.Snapshot()
+	assert.Equal(t, snap.Packets, int64(3))
+	assert.Equal(t, snap.Batches, int64(1))
+	assert.Equal(t, snap.Slots, int64(DefaultMessages))
+	assert.Equal(t, snap.Dropped, int64(2))
+	assert.Equal(t, snap.Drops[DropOverloaded], int64(2))
+	assert.Equal(t, snap.ReadErrors, int64(1))
+	assert.Equal(t, snap.InFlight, int64(1))
+	assert.Equal(t, snap.MaxInFlight, int64(1))
+	assert.Equal(t, snap.AverageBatch(), 3.0)
+	assert.Equal(t, snap.AverageFill(), 3.0/DefaultMessages)
+
+	// once the handler returns, its latency is recorded.
+	handler.Gate <- struct{}{}
+	waitIdle(stats)
+	snap = stats.Snapshot()
+	assert.Equal(t, snap.HandlerLatency.Count(), int64(1))
+	assert.That(t, snap.HandlerLatency.Sum > 0)
+}
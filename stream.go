@@ -0,0 +1,128 @@
+package admission
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/errs"
+)
+
+// StreamServer accepts stream connections, like TCP, and passes every framed
+// packet read from them to the Handler, just like a Dispatcher does for
+// datagrams. Packets from a single connection are handled in order.
+type StreamServer struct {
+	// Handler is an interface called with each read Message.
+	Handler Handler
+
+	// Listener is what connections are accepted from.
+	Listener net.Listener
+
+	// Hooks provide callbacks for events in the server.
+	Hooks struct {
+		// when a connection is closed because of an error.
+		ConnectionError func(ctx context.Context, err error)
+
+		// when a frame is skipped because it does not fit in a Message.
+		FrameTooLarge func(ctx context.Context)
+	}
+}
+
+// Serve accepts connections and handles the packets on them until the context
+// is cancelled. It closes the Listener and every connection before returning.
+func (s StreamServer) Serve(ctx context.Context) (err error) {
+	// wait for every goroutine after they have been told to stop.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu    sync.Mutex
+		conns = make(map[net.Conn]struct{})
+	)
+
+	// close the listener and all of the connections when the context is
+	// done to unblock any Accept or Read calls.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+
+		_ = s.Listener.Close()
+
+		mu.Lock()
+		for conn := range conns {
+			_ = conn.Close()
+		}
+		conns = nil
+		mu.Unlock()
+	}()
+
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errs.Wrap(err)
+		}
+
+		mu.Lock()
+		if conns == nil {
+			mu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		conns[conn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := s.serveConn(ctx, conn)
+			if err != nil && ctx.Err() == nil && s.Hooks.ConnectionError != nil {
+				s.Hooks.ConnectionError(ctx, err)
+			}
+
+			mu.Lock()
+			if conns != nil {
+				delete(conns, conn)
+			}
+			mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+// serveConn reads frames from the connection and handles them until the
+// connection is closed.
+func (s StreamServer) serveConn(ctx context.Context, conn net.Conn) (err error) {
+	br := bufio.NewReader(conn)
+	for {
+		m := getMessage()
+		m.Data, err = admproto.ReadFrame(br, m.Buffer()[:0])
+		if err == admproto.ErrFrameTooLarge {
+			m.Release()
+			if s.Hooks.FrameTooLarge != nil {
+				s.Hooks.FrameTooLarge(ctx)
+			}
+			continue
+		} else if err != nil {
+			m.Release()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		m.SetSource(conn.RemoteAddr())
+		s.Handler.Handle(ctx, m)
+		m.Release()
+	}
+}
@@ -0,0 +1,80 @@
+package admission
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zeebo/admission/v3/admproto"
+	"github.com/zeebo/assert"
+)
+
+// collectHandler records the data of every Message it handles.
+type collectHandler struct {
+	mu   sync.Mutex
+	data []string
+	seen chan struct{}
+}
+
+func newCollectHandler() *collectHandler {
+	return &collectHandler{seen: make(chan struct{}, 100)}
+}
+
+func (c *collectHandler) Handle(ctx context.Context, m *Message) {
+	c.mu.Lock()
+	c.data = append(c.data, string(m.Data))
+	c.mu.Unlock()
+	c.seen <- struct{}{}
+}
+
+func (c *collectHandler) collected() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.data...)
+}
+
+func TestStreamServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := newCollectHandler()
+	skipped := make(chan struct{}, 1)
+	server := StreamServer{Handler: handler, Listener: listener}
+	server.Hooks.FrameTooLarge = func(ctx context.Context) { skipped <- struct{}{} }
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(ctx) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// a frame too large for a Message is skipped without losing the rest.
+	large := strings.Repeat("x", 2*len(new(Message).Buffer()))
+
+	var stream []byte
+	var datagrams []string
+	for _, packet := range []string{"hello", large, "world"} {
+		datagram := admproto.AddChecksum([]byte(packet))
+		if packet != large {
+			datagrams = append(datagrams, string(datagram))
+		}
+		stream, err = admproto.AppendFrame(stream, datagram)
+		assert.NoError(t, err)
+	}
+	_, err = conn.Write(stream)
+	assert.NoError(t, err)
+
+	<-handler.seen
+	<-skipped
+	<-handler.seen
+	assert.DeepEqual(t, handler.collected(), datagrams)
+
+	cancel()
+	assert.NoError(t, <-errc)
+}